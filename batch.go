@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// pendingCommit is a batched zone publish that one or more record changes are
+// waiting for.
+type pendingCommit struct {
+	// challenges holds the challenges whose changes the publish covers.
+	challenges []*v1alpha1.ChallengeRequest
+	done       chan struct{}
+	err        error
+}
+
+// batchKey identifies the batched publish the changes staged for cfg can
+// share. Dyn only publishes the changes made in the publishing session, so
+// batches are per zone and session, and changes are only batched with those
+// of configs that publish the zone the same way, since the batch is published
+// with the config of its first change.
+func batchKey(cfg *dynDNSProviderConfig) string {
+	publishing, _ := json.Marshal([]interface{}{
+		cfg.ZoneName, cfg.ZoneAllowlist, cfg.CommitNotesTemplate,
+		cfg.ConfirmPublish, cfg.ConfirmPublishTimeout, cfg.PropagationCheckInterval,
+		cfg.PublishRetries, cfg.RetryBaseDelay,
+	})
+	key := sessionKey(cfg) + string(publishing)
+	if cfg.session != nil {
+		key = fmt.Sprintf("%s#%p", key, cfg.session)
+	}
+	return key
+}
+
+// commitChanges publishes the record changes staged for cfg's zone. When
+// commits are debounced, it waits for the batched publish that also covers
+// the changes staged by other calls during the debounce window.
+func (c *dynDNSProviderSolver) commitChanges(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+	if cfg.CommitDebounce.Duration == 0 {
+		return commit(c, cfg, ch)
+	}
+
+	key := batchKey(cfg)
+	c.pendingMu.Lock()
+	p, ok := c.pendingCommits[key]
+	if !ok {
+		p = &pendingCommit{done: make(chan struct{})}
+		if c.pendingCommits == nil {
+			c.pendingCommits = make(map[string]*pendingCommit)
+		}
+		c.pendingCommits[key] = p
+		time.AfterFunc(cfg.CommitDebounce.Duration, func() {
+			c.pendingMu.Lock()
+			delete(c.pendingCommits, key)
+			c.pendingMu.Unlock()
+
+			p.err = commit(c, cfg, p.challenges...)
+			close(p.done)
+		})
+	}
+	p.challenges = append(p.challenges, ch)
+	c.pendingMu.Unlock()
+
+	klog.V(4).Infof("waiting for the batched publish of zone %s", cfg.ZoneName)
+	<-p.done
+	return p.err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentCommitsDoNotOverlap(t *testing.T) {
+	dyn := newFakeDyn()
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if r.Method != "PUT" || !strings.HasPrefix(r.URL.Path, "/REST/Zone/") {
+			return nil, nil
+		}
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	ch := newTestChallenge()
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := commit(solver, &cfg, ch); err != nil {
+				t.Errorf("unexpected error committing: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight != 1 {
+		t.Errorf("expected publishes of one zone to be serialised, saw %d in flight", maxInFlight)
+	}
+}
+
+func TestCommitDebounceBatchesPublishes(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"key-1", "key-2"} {
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+			"commitDebounce": "100ms",
+		})
+		ch.Key = key
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := solver.Present(ch); err != nil {
+				t.Errorf("unexpected error presenting %q: %v", ch.Key, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 2 {
+		t.Errorf("expected both records to be created, got %v", got)
+	}
+	if dyn.publishes != 1 {
+		t.Errorf("expected a single batched publish, got %d", dyn.publishes)
+	}
+}
+
+func TestCommitDebounceNotesNameAllChallenges(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"example.com", "www.example.com"} {
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+			"commitDebounce":      "100ms",
+			"commitNotesTemplate": "records {{.FQDN}}",
+		})
+		ch.DNSName = name
+		ch.ResolvedFQDN = "_acme-challenge." + name
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := solver.Present(ch); err != nil {
+				t.Errorf("unexpected error presenting %q: %v", ch.DNSName, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	notes := dyn.payload("PUT Zone/example.com/")
+	for _, fqdn := range []string{"_acme-challenge.example.com", "_acme-challenge.www.example.com"} {
+		if !strings.Contains(notes, fqdn) {
+			t.Errorf("expected the notes of the batched publish to name %s, got %s", fqdn, notes)
+		}
+	}
+}
+
+func TestCommitDebounceSeparatesPublishSettings(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	var wg sync.WaitGroup
+	for i, tmpl := range []string{"first {{.FQDN}}", "second {{.FQDN}}"} {
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+			"commitDebounce":      "100ms",
+			"commitNotesTemplate": tmpl,
+		})
+		ch.Key = fmt.Sprintf("key-%d", i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := solver.Present(ch); err != nil {
+				t.Errorf("unexpected error presenting %q: %v", ch.Key, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(dyn.sent("PUT Zone/example.com/")); got != 2 {
+		t.Errorf("expected a publish per notes template, got %d", got)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultCircuitBreakerCooldown is how long the circuit to the Dyn API stays
+// open when the config does not say otherwise.
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// ErrCircuitOpen is returned for Dyn API requests that are not made because
+// too many requests in a row failed, and the circuit breaker is open.
+var ErrCircuitOpen = errors.New("Dyn API circuit open")
+
+// circuitBreakerCooldown returns how long the circuit to the Dyn API stays
+// open before a request is let through to probe it.
+func (cfg *dynDNSProviderConfig) circuitBreakerCooldown() time.Duration {
+	if cfg.CircuitBreakerCooldown.Duration == 0 {
+		return defaultCircuitBreakerCooldown
+	}
+	return cfg.CircuitBreakerCooldown.Duration
+}
+
+// circuitBreaker fails Dyn API requests fast once threshold requests in a row
+// have failed. After the cooldown it lets a single request through to probe
+// whether Dyn recovered, closing the circuit if it succeeds and opening it
+// again if it fails.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	open      bool
+	openedAt  time.Time
+	probing   bool
+}
+
+// allow returns ErrCircuitOpen if a request may not be made.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// abandon records a request made that ended without an outcome, such as one
+// canceled by its caller, letting another request probe the API if it was
+// the probe.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// record records the outcome of a request made.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.open {
+			logInfo("Dyn API recovered, closing the circuit", logFields{})
+		}
+		b.failures, b.open, b.probing = 0, false, false
+		return
+	}
+
+	b.failures++
+	if b.probing || (!b.open && b.failures >= b.threshold) {
+		b.open, b.openedAt, b.probing = true, time.Now(), false
+		logError("Dyn API requests keep failing, opening the circuit", logFields{
+			"attempts": b.failures,
+			"duration": b.cooldown,
+		})
+	}
+}
+
+// circuitBreakerKey returns the key of the circuit breaker for cfg, which is
+// shared by all configs for the same Dyn API endpoint and breaker settings.
+func circuitBreakerKey(cfg *dynDNSProviderConfig) string {
+	key, _ := json.Marshal([]interface{}{cfg.APIEndpoint, cfg.CircuitBreakerThreshold, cfg.circuitBreakerCooldown()})
+	return string(key)
+}
+
+// circuitBreaker returns the circuit breaker of the Dyn API endpoint of cfg,
+// configured by cfg, or nil if cfg does not enable it.
+func (c *dynDNSProviderSolver) circuitBreaker(cfg *dynDNSProviderConfig) *circuitBreaker {
+	if cfg.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+
+	key := circuitBreakerKey(cfg)
+	c.breakersMu.Lock()
+	defer c.breakersMu.Unlock()
+	b, ok := c.breakers[key]
+	if !ok {
+		b = &circuitBreaker{threshold: cfg.CircuitBreakerThreshold, cooldown: cfg.circuitBreakerCooldown()}
+		if c.breakers == nil {
+			c.breakers = make(map[string]*circuitBreaker)
+		}
+		c.breakers[key] = b
+	}
+	return b
+}
+
+// circuitBreakerTransport fails requests with ErrCircuitOpen while the
+// breaker is open. Requests failing without a response or with a server
+// error count as failures, but requests canceled by their caller do not,
+// since they say nothing about the health of the API.
+type circuitBreakerTransport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil && errors.Is(err, context.Canceled) {
+		t.breaker.abandon()
+		return resp, err
+	}
+	t.breaker.record(err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
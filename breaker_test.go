@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	dyn := newFakeDyn()
+	var mu sync.Mutex
+	failing := true
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	}
+	calls := func() int {
+		dyn.mu.Lock()
+		defer dyn.mu.Unlock()
+		return len(dyn.requests)
+	}
+	roundTrip := func(transport http.RoundTripper) error {
+		req, _ := http.NewRequest("GET", "https://api.dynect.net/REST/Zone/example.com/", nil)
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	solver := &dynDNSProviderSolver{}
+	cfg := dynDNSProviderConfig{CircuitBreakerThreshold: 2, CircuitBreakerCooldown: duration{50 * time.Millisecond}}
+	transport := &circuitBreakerTransport{breaker: solver.circuitBreaker(&cfg), next: dyn}
+
+	for i := 0; i < 2; i++ {
+		if err := roundTrip(transport); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected request %d to reach the API and fail, got %v", i, err)
+		}
+	}
+	if err := roundTrip(transport); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	if got := calls(); got != 2 {
+		t.Errorf("expected the open circuit to fail fast, got %d calls", got)
+	}
+
+	// A failed probe opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	if err := roundTrip(transport); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the probe to reach the API and fail, got %v", err)
+	}
+	if err := roundTrip(transport); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to open again after a failed probe, got %v", err)
+	}
+
+	// A successful probe closes it.
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if err := roundTrip(transport); err != nil {
+			t.Fatalf("expected request %d to succeed once the circuit closed, got %v", i, err)
+		}
+	}
+	if got := calls(); got != 6 {
+		t.Errorf("expected 6 calls, got %d", got)
+	}
+
+	if solver.circuitBreaker(&dynDNSProviderConfig{}) != nil {
+		t.Error("expected no circuit breaker without a threshold")
+	}
+}
+
+func TestCircuitBreakerIgnoresCanceledRequests(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		return nil, r.Context().Err()
+	}
+	solver := &dynDNSProviderSolver{}
+	cfg := dynDNSProviderConfig{CircuitBreakerThreshold: 1}
+	transport := &circuitBreakerTransport{breaker: solver.circuitBreaker(&cfg), next: dyn}
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.dynect.net/REST/Zone/example.com/", nil)
+		if _, err := transport.RoundTrip(req); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected request %d to be canceled, got %v", i, err)
+		}
+	}
+}
+
+func TestCircuitBreakerSettings(t *testing.T) {
+	solver := &dynDNSProviderSolver{}
+	strict := solver.circuitBreaker(&dynDNSProviderConfig{CircuitBreakerThreshold: 1})
+	lenient := solver.circuitBreaker(&dynDNSProviderConfig{CircuitBreakerThreshold: 10, CircuitBreakerCooldown: duration{time.Minute}})
+	if strict == lenient {
+		t.Fatal("expected configs with different settings not to share a circuit breaker")
+	}
+	if strict.threshold != 1 || strict.cooldown != defaultCircuitBreakerCooldown {
+		t.Errorf("expected the first breaker to keep its settings, got %d and %v", strict.threshold, strict.cooldown)
+	}
+	if got := solver.circuitBreaker(&dynDNSProviderConfig{CircuitBreakerThreshold: 1, CircuitBreakerCooldown: duration{defaultCircuitBreakerCooldown}}); got != strict {
+		t.Error("expected configs with the same settings to share a circuit breaker")
+	}
+}
+
+func TestCircuitBreakerFailsChallengesFast(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"circuitBreakerThreshold": 1})
+
+	if err := solver.Present(ch); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the first challenge to reach the API and fail, got %v", err)
+	}
+	before := len(dyn.requests)
+	err := solver.Present(ch)
+	if !errors.Is(err, ErrCircuitOpen) || !strings.Contains(err.Error(), "Dyn API circuit open") {
+		t.Errorf("expected the second challenge to fail with ErrCircuitOpen, got %v", err)
+	}
+	if calls := len(dyn.requests) - before; calls != 0 {
+		t.Errorf("expected no requests while the circuit is open, got %d", calls)
+	}
+}
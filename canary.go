@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+// canaryRecordLabel is the name, relative to the canary zone, of the TXT
+// record created by the startup self-test.
+const canaryRecordLabel = "_dyndns-self-test"
+
+// canaryChecks is how often the self-test reads the canary record back after
+// publishing it before giving up.
+const canaryChecks = 3
+
+// errSelfTestPending is reported by the readiness endpoint until the startup
+// self-test has finished.
+var errSelfTestPending = errors.New("startup self-test has not finished")
+
+// selfTest holds the result of the startup self-test.
+type selfTest struct {
+	mu      sync.Mutex
+	enabled bool
+	done    bool
+	err     error
+}
+
+// status returns nil once the self-test passed, or if it is disabled, and the
+// reason the webhook is not ready otherwise.
+func (s *selfTest) status() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !s.enabled:
+		return nil
+	case !s.done:
+		return errSelfTestPending
+	case s.err != nil:
+		return fmt.Errorf("startup self-test failed: %v", s.err)
+	}
+	return nil
+}
+
+// canaryConfigFromEnv returns the solver config of the startup self-test
+// from CANARY_ZONE, CANARY_USERNAME, CANARY_CUSTOMER_NAME,
+// CANARY_PASSWORD_FILE and the optional CANARY_API_ENDPOINT, or nil if
+// CANARY_ZONE is not set.
+func canaryConfigFromEnv(getenv func(string) string) *dynDNSProviderConfig {
+	zone := trimDot(getenv("CANARY_ZONE"))
+	if zone == "" {
+		return nil
+	}
+	return &dynDNSProviderConfig{
+		Username:                getenv("CANARY_USERNAME"),
+		CustomerName:            getenv("CANARY_CUSTOMER_NAME"),
+		PasswordFile:            getenv("CANARY_PASSWORD_FILE"),
+		trustedFiles:            true,
+		APIEndpoint:             getenv("CANARY_API_ENDPOINT"),
+		ZoneName:                zone,
+		PropagationCheckRetries: canaryChecks,
+	}
+}
+
+// startSelfTest runs the startup self-test against the canary zone of cfg in
+// the background. The webhook is reported as not ready until it passes.
+func (c *dynDNSProviderSolver) startSelfTest(cfg *dynDNSProviderConfig) {
+	c.selfTest.mu.Lock()
+	c.selfTest.enabled = true
+	c.selfTest.mu.Unlock()
+
+	go func() {
+		err := c.runSelfTest(*cfg)
+
+		c.selfTest.mu.Lock()
+		c.selfTest.done, c.selfTest.err = true, err
+		c.selfTest.mu.Unlock()
+	}()
+}
+
+// runSelfTest creates a TXT record in the canary zone of cfg, publishes it
+// and reads it back, then deletes it and publishes the zone again, using the
+// same steps as a challenge.
+func (c *dynDNSProviderSolver) runSelfTest(cfg dynDNSProviderConfig) error {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	ch := &v1alpha1.ChallengeRequest{
+		Key:          hex.EncodeToString(key),
+		ResolvedFQDN: canaryRecordLabel + "." + cfg.ZoneName + ".",
+		ResolvedZone: cfg.ZoneName + ".",
+	}
+	cfg.requestID = challengeRequestID(ch)
+	fields := cfg.logFields(logFields{"zone": cfg.ZoneName, "fqdn": ch.ResolvedFQDN, "operation": "self-test"})
+
+	err := c.present(cfg, ch)
+	if err == nil {
+		err = c.cleanUp(cfg, ch)
+	} else if cleanupErr := c.cleanUp(cfg, ch); cleanupErr != nil {
+		logError("Error cleaning up after the failed self-test", cfg.logFields(logFields{"error": cleanupErr}))
+	}
+	if err != nil {
+		fields["error"] = err
+		logError("Startup self-test failed", fields)
+		return err
+	}
+	logInfo("Startup self-test passed", fields)
+	return nil
+}
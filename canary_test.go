@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestSelfTest(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("canary-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"CANARY_ZONE":          "canary.example.com.",
+		"CANARY_USERNAME":      "canary-user",
+		"CANARY_CUSTOMER_NAME": "canary-customer",
+		"CANARY_PASSWORD_FILE": passwordFile,
+	}
+	const records = "TXTRecord/canary.example.com/_dyndns-self-test.canary.example.com/"
+
+	tests := []struct {
+		name      string
+		failures  map[string]int
+		wantReady bool
+	}{
+		{name: "passes", wantReady: true},
+		{name: "fails", failures: map[string]int{"POST " + records: http.StatusBadRequest}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			dyn.failures = tt.failures
+			solver := newTestSolver(dyn)
+			readyz := func() *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				solver.serveReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+				return rec
+			}
+
+			cfg := canaryConfigFromEnv(func(name string) string { return env[name] })
+			if cfg == nil {
+				t.Fatal("expected the self-test to be configured")
+			}
+			cfg.PropagationCheckInterval = duration{time.Millisecond}
+			solver.startSelfTest(cfg)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for errors.Is(solver.selfTest.status(), errSelfTestPending) {
+				if time.Now().After(deadline) {
+					t.Fatal("self-test did not finish")
+				}
+				if rec := readyz(); rec.Code != http.StatusServiceUnavailable {
+					t.Errorf("expected not to be ready while the self-test runs, got %d", rec.Code)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			rec := readyz()
+			if ready := rec.Code == http.StatusOK; ready != tt.wantReady {
+				t.Errorf("expected ready %v, got %d: %s", tt.wantReady, rec.Code, rec.Body.String())
+			}
+			if got := dyn.txtValues("canary.example.com", "_dyndns-self-test.canary.example.com"); len(got) != 0 {
+				t.Errorf("expected the canary record to be deleted, got %v", got)
+			}
+			if tt.wantReady && dyn.publishes != 2 {
+				t.Errorf("expected the canary zone to be published twice, got %d", dyn.publishes)
+			}
+		})
+	}
+
+	if canaryConfigFromEnv(func(string) string { return "" }) != nil {
+		t.Error("expected the self-test to be disabled without CANARY_ZONE")
+	}
+}
+
+func TestSelfTestStartsOnInitialize(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("canary-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	solver.canary = &dynDNSProviderConfig{
+		Username:                 "canary-user",
+		CustomerName:             "canary-customer",
+		PasswordFile:             passwordFile,
+		trustedFiles:             true,
+		ZoneName:                 "canary.example.com",
+		PropagationCheckRetries:  canaryChecks,
+		PropagationCheckInterval: duration{time.Millisecond},
+	}
+	solver.selfTest.enabled = true
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := solver.Initialize(&rest.Config{}, stopCh); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for errors.Is(solver.selfTest.status(), errSelfTestPending) {
+		if time.Now().After(deadline) {
+			t.Fatal("self-test did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := solver.selfTest.status(); err != nil {
+		t.Errorf("expected the self-test to pass, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nesv/go-dynect/dynect"
+)
+
+// testCommand is the subcommand checking Dyn credentials and a zone from the
+// command line, without running the webhook.
+const testCommand = "test"
+
+// runTestCommand logs in to Dyn with the credentials given in args, looks up
+// the zone and logs out again, reporting every step to out. The password is
+// read from the file given by -password-file, or from stdin by default. A
+// failure to log out is returned as an error too.
+func runTestCommand(args []string, stdin io.Reader, out io.Writer) (err error) {
+	flags := flag.NewFlagSet(testCommand, flag.ContinueOnError)
+	flags.SetOutput(out)
+	var cfg dynDNSProviderConfig
+	flags.StringVar(&cfg.Username, "username", "", "Dyn username")
+	flags.StringVar(&cfg.CustomerName, "customer-name", "", "Dyn customer name")
+	flags.StringVar(&cfg.ZoneName, "zone", "", "Dyn zone to look up")
+	flags.StringVar(&cfg.APIEndpoint, "api-endpoint", "", "Dyn API base URL, defaults to https://api.dynect.net/REST")
+	passwordFile := flags.String("password-file", "-", "file to read the Dyn password from, - for stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if cfg.Username == "" || cfg.CustomerName == "" || cfg.ZoneName == "" {
+		return errors.New("-username, -customer-name and -zone are required")
+	}
+	cfg.ZoneName = trimDot(cfg.ZoneName)
+
+	password, err := readPassword(*passwordFile, stdin)
+	if err != nil {
+		return fmt.Errorf("error reading the password: %v", err)
+	}
+
+	c := &dynDNSProviderSolver{}
+	dynClient, err := c.loginWithPassword(&cfg, password)
+	if err != nil {
+		return fmt.Errorf("login as %s of %s failed: %v", cfg.Username, cfg.CustomerName, err)
+	}
+	fmt.Fprintf(out, "Logged in as %s of %s\n", cfg.Username, cfg.CustomerName)
+	defer func() {
+		if logoutErr := logout(dynClient, cfg.sessionPath()); logoutErr != nil {
+			if err == nil {
+				err = fmt.Errorf("logging out failed: %v", logoutErr)
+			} else {
+				err = fmt.Errorf("%v, and logging out failed: %v", err, logoutErr)
+			}
+			return
+		}
+		fmt.Fprintln(out, "Logged out")
+	}()
+
+	var zone dynect.ZoneResponse
+	if err := callDyn(dynClient, "", "GET", buildZoneLink(cfg.ZoneName), nil, &zone); err != nil {
+		return fmt.Errorf("looking up zone %s failed: %v", cfg.ZoneName, err)
+	}
+	fmt.Fprintf(out, "Found zone %s\n", cfg.ZoneName)
+
+	return nil
+}
+
+// readPassword reads the password from the named file, or from stdin if the
+// name is -, stripping the trailing newline.
+func readPassword(name string, stdin io.Reader) (string, error) {
+	if name != "-" {
+		return readCredentialFile(name)
+	}
+	password, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
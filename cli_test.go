@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTestCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures map[string]int
+		wantErr  string
+		wantOut  []string
+	}{
+		{
+			name:    "valid credentials and zone",
+			wantOut: []string{"Logged in as user of customer", "Found zone example.com", "Logged out"},
+		},
+		{
+			name:     "failed login",
+			failures: map[string]int{"POST Session": http.StatusBadRequest},
+			wantErr:  "login as user of customer failed",
+		},
+		{
+			name:     "unknown zone",
+			failures: map[string]int{"GET Zone/example.com/": http.StatusNotFound},
+			wantErr:  "looking up zone example.com failed",
+			wantOut:  []string{"Logged in as user of customer", "Logged out"},
+		},
+		{
+			name:     "failed logout",
+			failures: map[string]int{"DELETE Session": http.StatusInternalServerError},
+			wantErr:  "logging out failed",
+			wantOut:  []string{"Logged in as user of customer", "Found zone example.com"},
+		},
+		{
+			name:     "unknown zone and failed logout",
+			failures: map[string]int{"GET Zone/example.com/": http.StatusNotFound, "DELETE Session": http.StatusInternalServerError},
+			wantErr:  "looking up zone example.com failed",
+			wantOut:  []string{"Logged in as user of customer"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			dyn.failures = tt.failures
+			server := httptest.NewServer(dyn)
+			defer server.Close()
+
+			var out strings.Builder
+			err := runTestCommand([]string{
+				"-username", "user",
+				"-customer-name", "customer",
+				"-zone", "example.com.",
+				"-api-endpoint", server.URL + "/REST",
+			}, strings.NewReader("secret\n"), &out)
+
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+			if got := strings.Split(strings.TrimSpace(out.String()), "\n"); tt.wantOut != nil && strings.Join(got, "\n") != strings.Join(tt.wantOut, "\n") {
+				t.Errorf("expected output %q, got %q", tt.wantOut, got)
+			}
+		})
+	}
+}
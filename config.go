@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// webhookConfigFile is the file given by the --config flag. Its fields are
+// defaults for the environment variables of the same meaning, which take
+// precedence over them when set.
+type webhookConfigFile struct {
+	GroupName     string   `json:"groupName"`
+	SolverName    string   `json:"solverName"`
+	ZoneAllowlist []string `json:"zoneAllowlist"`
+	ClusterID     string   `json:"clusterID"`
+	LogFormat     string   `json:"logFormat"`
+	MetricsPort   string   `json:"metricsPort"`
+	Defaults      struct {
+		Username     string `json:"username"`
+		CustomerName string `json:"customerName"`
+		ZoneName     string `json:"zoneName"`
+	} `json:"defaults"`
+}
+
+// env returns the environment variables set by f.
+func (f *webhookConfigFile) env() map[string]string {
+	return map[string]string{
+		"GROUP_NAME":            f.GroupName,
+		"SOLVER_NAME":           f.SolverName,
+		"ZONE_ALLOWLIST":        strings.Join(f.ZoneAllowlist, ","),
+		"CLUSTER_ID":            f.ClusterID,
+		"LOG_FORMAT":            f.LogFormat,
+		"METRICS_PORT":          f.MetricsPort,
+		"DEFAULT_USERNAME":      f.Defaults.Username,
+		"DEFAULT_CUSTOMER_NAME": f.Defaults.CustomerName,
+		"DEFAULT_ZONE_NAME":     f.Defaults.ZoneName,
+	}
+}
+
+// applyConfigFile sets the environment variables that are empty from the
+// config file at path, so that the rest of the webhook reads them as if
+// they had been given in the environment.
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	var f webhookConfigFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return fmt.Errorf("error decoding config file %s: %v", path, err)
+	}
+	for name, value := range f.env() {
+		if value == "" || os.Getenv(name) != "" {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"groupName": "acme.example.com", "solverName": "dyndns-file", "zoneAllowlist": ["example.com", "example.org"], "defaults": {"zoneName": "example.com"}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GROUP_NAME", "")
+	t.Setenv("SOLVER_NAME", "dyndns-env")
+	t.Setenv("ZONE_ALLOWLIST", "")
+	t.Setenv("DEFAULT_ZONE_NAME", "")
+	t.Setenv("CLUSTER_ID", "")
+
+	if err := applyConfigFile(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{
+		"GROUP_NAME":        "acme.example.com",
+		"SOLVER_NAME":       "dyndns-env",
+		"ZONE_ALLOWLIST":    "example.com,example.org",
+		"DEFAULT_ZONE_NAME": "example.com",
+		"CLUSTER_ID":        "",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("expected %s %q, got %q", name, want, got)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"groupname": "acme.example.com", "group": "typo"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(path); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+	if err := applyConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+// followDelegation returns ch with its resolved FQDN replaced by the target of
+// the CNAME delegating it, if cfg.FollowDelegation is set and there is one.
+// ch is returned as is otherwise, and is never modified.
+func (c *dynDNSProviderSolver) followDelegation(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) (*v1alpha1.ChallengeRequest, error) {
+	if !cfg.FollowDelegation {
+		return ch, nil
+	}
+
+	lookup := c.lookupCNAME
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupCNAME
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.requestTimeout())
+	defer cancel()
+
+	target, err := lookup(ctx, ch.ResolvedFQDN)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return ch, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dyndns error looking up the delegation of %s: %v", ch.ResolvedFQDN, err)
+	}
+	if trimDot(target) == trimDot(ch.ResolvedFQDN) {
+		return ch, nil
+	}
+
+	logDebug("Following delegation", cfg.logFields(logFields{"fqdn": ch.ResolvedFQDN, "target": target}))
+	delegated := *ch
+	delegated.ResolvedFQDN = trimDot(target) + "."
+	return &delegated, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFollowDelegation(t *testing.T) {
+	tests := []struct {
+		name     string
+		follow   bool
+		cname    string
+		err      error
+		wantFQDN string
+		wantErr  bool
+	}{
+		{name: "disabled", cname: "_acme-challenge.example.org.", wantFQDN: "_acme-challenge.example.com"},
+		{name: "delegated", follow: true, cname: "_acme-challenge.example.org.", wantFQDN: "_acme-challenge.example.org"},
+		{name: "not delegated", follow: true, cname: "_acme-challenge.example.com.", wantFQDN: "_acme-challenge.example.com"},
+		{name: "no records", follow: true, err: &net.DNSError{Err: "no such host", IsNotFound: true}, wantFQDN: "_acme-challenge.example.com"},
+		{name: "lookup failure", follow: true, err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			solver := newTestSolver(dyn)
+			solver.lookupCNAME = func(ctx context.Context, host string) (string, error) {
+				return tt.cname, tt.err
+			}
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"zonename":         "",
+				"zones":            []map[string]string{{"name": "example.com"}, {"name": "example.org"}},
+				"followDelegation": tt.follow,
+			})
+
+			err := solver.Present(ch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			zone := tt.wantFQDN[strings.Index(tt.wantFQDN, ".")+1:]
+			if got := dyn.txtValues(zone, tt.wantFQDN); len(got) != 1 {
+				t.Errorf("expected the record at %s, got %v", tt.wantFQDN, got)
+			}
+		})
+	}
+}
+
+func TestDelegatedSubzone(t *testing.T) {
+	const subzone = "_acme-challenge.example.com"
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	ch := newTestChallenge()
+	ch.ResolvedZone = subzone + "."
+
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"GET TXTRecord/" + subzone + "/" + subzone + "/",
+		"POST TXTRecord/" + subzone + "/" + subzone + "/",
+		"PUT Zone/" + subzone + "/",
+	}
+	if got := dyn.endpoints(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected requests %v, got %v", want, got)
+	}
+}
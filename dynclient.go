@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/nesv/go-dynect/dynect"
+)
+
+// dynClientInterface is the part of the go-dynect client used by the solver.
+// It allows the Dyn API to be replaced with a fake in tests.
+type dynClientInterface interface {
+	Do(method, endpoint string, requestData, responseData interface{}) error
+	// SetToken sets the session token sent with every request.
+	SetToken(token string)
+}
+
+// dynectClient adapts a go-dynect client to dynClientInterface.
+type dynectClient struct {
+	*dynect.Client
+	// timeout returns the timeout of an operation with method to endpoint.
+	timeout func(method, endpoint string) time.Duration
+}
+
+// Do bounds the whole operation, including reading its response and polling
+// the job Dyn may promote it to, by the timeout of the operation, so that a
+// hung connection or a job that never completes cannot block the solver.
+func (c dynectClient) Do(method, endpoint string, requestData, responseData interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout(method, endpoint))
+	defer cancel()
+	client := *c.Client
+	client.Transport = &contextTransport{ctx: ctx, next: c.Client.Transport}
+	return client.Do(method, endpoint, requestData, responseData)
+}
+
+func (c dynectClient) SetToken(token string) {
+	c.Token = token
+}
+
+// clientFactory returns the function used to create Dyn clients, defaulting
+// to go-dynect clients.
+func (c *dynDNSProviderSolver) clientFactory() func(cfg *dynDNSProviderConfig) (dynClientInterface, error) {
+	if c.newDynClient != nil {
+		return c.newDynClient
+	}
+	return c.newDynectClient
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nesv/go-dynect/dynect"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/REST/TXTRecord/") {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"requestTimeout": "10ms",
+		"maxRetries":     -1,
+	})
+	done := make(chan error)
+	go func() { done <- solver.Present(ch) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error when the request times out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Present did not return after the request timed out")
+	}
+}
+
+func TestOperationTimeoutCoversJobPolling(t *testing.T) {
+	interval := dynect.PollingInterval
+	dynect.PollingInterval = time.Millisecond
+	defer func() { dynect.PollingInterval = interval }()
+
+	dyn := newFakeDyn()
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if err := r.Context().Err(); err != nil {
+			return nil, err
+		}
+		switch {
+		case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/REST/TXTRecord/"):
+			resp := dyn.respondJSON(http.StatusTemporaryRedirect, "")
+			resp.Header.Set("Location", "/REST/Job/1")
+			return resp, nil
+		case strings.HasPrefix(r.URL.Path, "/REST/Job/"):
+			return dyn.respondJSON(http.StatusOK, `{"status": "incomplete"}`), nil
+		}
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"createTimeout": "50ms"})
+	done := make(chan error)
+	go func() { done <- solver.Present(ch) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the create to time out while its job is polled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Present did not return while the job of the create was polled")
+	}
+}
+
+func TestOperationTimeouts(t *testing.T) {
+	dyn := newFakeDyn()
+	var mu sync.Mutex
+	timeouts := map[string]time.Duration{}
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if deadline, ok := r.Context().Deadline(); ok {
+			operation := r.Method + " " + strings.SplitN(strings.TrimPrefix(r.URL.Path, "/REST/"), "/", 2)[0]
+			mu.Lock()
+			timeouts[operation] = time.Until(deadline).Round(time.Second)
+			mu.Unlock()
+		}
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"requestTimeout": "3s",
+		"createTimeout":  "5s",
+		"deleteTimeout":  "7s",
+		"publishTimeout": "11s",
+	})
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	if err := solver.CleanUp(ch); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+
+	want := map[string]time.Duration{
+		"POST Session":     3 * time.Second,
+		"GET TXTRecord":    3 * time.Second,
+		"POST TXTRecord":   5 * time.Second,
+		"DELETE TXTRecord": 7 * time.Second,
+		"PUT Zone":         11 * time.Second,
+	}
+	for operation, timeout := range want {
+		if got := timeouts[operation]; got != timeout {
+			t.Errorf("expected %s to time out after %v, got %v", operation, timeout, got)
+		}
+	}
+}
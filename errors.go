@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nesv/go-dynect/dynect"
+)
+
+var (
+	// ErrAuthentication is returned when Dyn rejects the configured
+	// credentials. The error wrapping it carries the Dyn message.
+	ErrAuthentication = errors.New("dyndns authentication failed")
+	// ErrAuthorization is returned when Dyn denies the account permission
+	// for an operation, such as changing a zone it has no access to. The
+	// error wrapping it carries the Dyn message.
+	ErrAuthorization = errors.New("dyndns authorization failed")
+)
+
+// RetryableError is implemented by the typed errors of the solver. It reports
+// whether the failed operation may succeed when cert-manager retries it, or
+// needs the config or the Dyn account to be fixed first.
+type RetryableError interface {
+	error
+	IsRetryable() bool
+}
+
+// SolverError is returned by Present and CleanUp. Its message ends with
+// whether the error is retryable, to help operators triaging failed
+// challenges.
+type SolverError struct {
+	// Retryable is set when retrying the operation may succeed.
+	Retryable bool
+	// Err is the error the operation failed with.
+	Err error
+}
+
+func (e *SolverError) Error() string {
+	if e.Retryable {
+		return fmt.Sprintf("%v (retryable)", e.Err)
+	}
+	return fmt.Sprintf("%v (non-retryable)", e.Err)
+}
+
+func (e *SolverError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SolverError) IsRetryable() bool {
+	return e.Retryable
+}
+
+// solverError wraps err, unless it is nil, in a SolverError classifying it.
+func solverError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var solverErr *SolverError
+	if errors.As(err, &solverErr) {
+		return err
+	}
+	return &SolverError{Retryable: isRetryable(err), Err: err}
+}
+
+// isRetryable reports whether the operation that failed with err may succeed
+// when it is retried. Errors are retryable unless they are known to be caused
+// by the config, the challenge request or the Dyn account.
+func isRetryable(err error) bool {
+	var retryable RetryableError
+	if errors.As(err, &retryable) {
+		return retryable.IsRetryable()
+	}
+	if errors.Is(err, ErrAuthentication) || errors.Is(err, ErrAuthorization) {
+		return false
+	}
+	if code := dynStatusCode(err); code >= 400 && code < 500 {
+		return code == 408 || code == 429 || isSessionInvalid(err) || isOperationInProgress(err)
+	}
+	return true
+}
+
+// ConfigError is returned when the solver config or the challenge request is
+// invalid, which retrying cannot fix.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConfigError) IsRetryable() bool {
+	return false
+}
+
+// SecretKeyNotFoundError is returned when a secret referenced by the solver
+// config exists but does not contain the referenced key.
+type SecretKeyNotFoundError struct {
+	Name      string
+	Namespace string
+	Key       string
+}
+
+func (e *SecretKeyNotFoundError) Error() string {
+	return fmt.Sprintf("Key %q not found in secret \"%s/%s\"", e.Key, e.Namespace, e.Name)
+}
+
+func (e *SecretKeyNotFoundError) IsRetryable() bool {
+	return false
+}
+
+// CommitFailedAfterCreateError is returned by Present when the challenge
+// record was created, or found already, but publishing the zone failed. The
+// record is then staged in the Dyn session but not served. Retrying Present
+// recovers, since Present publishes the zone even if the record exists.
+type CommitFailedAfterCreateError struct {
+	// Zone is the Dyn zone that failed to publish.
+	Zone string
+	// Record is the link of the TXT records the challenge record was
+	// created at, or of the record updated in place.
+	Record string
+	// JobID is the Dyn job that created the record, if Dyn returned one.
+	JobID int
+	// Err is the error publishing the zone.
+	Err error
+}
+
+func (e *CommitFailedAfterCreateError) Error() string {
+	return fmt.Sprintf("dyndns TXT record %s was created but publishing zone %s failed: %v", e.Record, e.Zone, e.Err)
+}
+
+func (e *CommitFailedAfterCreateError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports true, since a retried Present finds the record and
+// publishes the zone again.
+func (e *CommitFailedAfterCreateError) IsRetryable() bool {
+	return true
+}
+
+// TargetsError is returned when a challenge with several targets failed for
+// more of them than its target quorum allows.
+type TargetsError struct {
+	// Total is the number of targets.
+	Total int
+	// Quorum is the number of targets the challenge had to succeed for.
+	Quorum int
+	// Errors holds the error of every target the challenge failed for.
+	Errors []error
+}
+
+func (e *TargetsError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("dyndns challenge succeeded for %d of %d targets, %d required: %s",
+		e.Total-len(e.Errors), e.Total, e.Quorum, strings.Join(msgs, "; "))
+}
+
+// IsRetryable reports whether the quorum can still be reached by retrying
+// the targets that failed with retryable errors.
+func (e *TargetsError) IsRetryable() bool {
+	permanent := 0
+	for _, err := range e.Errors {
+		if !isRetryable(err) {
+			permanent++
+		}
+	}
+	return e.Total-permanent >= e.Quorum
+}
+
+// DynStatusError is returned when the Dyn API accepts a request but reports
+// that it failed in the status of the response body.
+type DynStatusError struct {
+	Status   string
+	Messages []dynect.MessageBlock
+}
+
+func (e *DynStatusError) Error() string {
+	msgs := make([]string, 0, len(e.Messages))
+	for _, m := range e.Messages {
+		if m.Info != "" {
+			msgs = append(msgs, m.Info)
+		}
+	}
+	if len(msgs) == 0 {
+		return fmt.Sprintf("Dyn responded with status %q", e.Status)
+	}
+	return fmt.Sprintf("Dyn responded with status %q: %s", e.Status, strings.Join(msgs, "; "))
+}
+
+// IsRetryable reports whether Dyn rejected the request only because another
+// operation on the zone was in progress.
+func (e *DynStatusError) IsRetryable() bool {
+	return isOperationInProgress(e)
+}
+
+// checkStatus returns a DynStatusError if resp does not report success.
+func checkStatus(resp dynect.ResponseBlock) error {
+	if resp.Status == "success" {
+		return nil
+	}
+	return &DynStatusError{Status: resp.Status, Messages: resp.Messages}
+}
+
+// dynStatusPrefix starts the error go-dynect returns when the Dyn API responds
+// with an unexpected HTTP status code.
+const dynStatusPrefix = "server responded with "
+
+// dynStatusCode returns the HTTP status code of a Dyn API error returned by
+// go-dynect, or 0 if err is not such an error.
+func dynStatusCode(err error) int {
+	if err == nil || !strings.HasPrefix(err.Error(), dynStatusPrefix) {
+		return 0
+	}
+	status := strings.TrimPrefix(err.Error(), dynStatusPrefix)
+	if i := strings.IndexByte(status, ' '); i >= 0 {
+		status = status[:i]
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// expiredSessionMessages are the Dyn error messages signalling that a session
+// token is no longer valid and a new login is required.
+var expiredSessionMessages = []string{
+	"login: Bad or expired credentials",
+	"login: IP address does not match current session",
+}
+
+// isSessionInvalid reports whether err is Dyn rejecting the session token,
+// either with a 401 or with one of the messages it uses for expired sessions.
+func isSessionInvalid(err error) bool {
+	code := dynStatusCode(err)
+	if code == 401 {
+		return true
+	}
+	if code == 0 {
+		return false
+	}
+	for _, msg := range expiredSessionMessages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// operationInProgressMessages are the Dyn error messages signalling that the
+// request was rejected because another operation on the zone is in progress.
+var operationInProgressMessages = []string{
+	"Operation blocked by current task",
+	"This session already has a job running",
+}
+
+// isOperationInProgress reports whether err is Dyn rejecting a request because
+// another operation is in progress, either with an error status or in the
+// status of the response body.
+func isOperationInProgress(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*DynStatusError); !ok && dynStatusCode(err) == 0 {
+		return false
+	}
+	for _, msg := range operationInProgressMessages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// noPendingChangesMessages are the Dyn error messages signalling that a zone
+// publish had no pending changes to publish.
+var noPendingChangesMessages = []string{
+	"No changes to publish",
+	"No pending changes",
+}
+
+// isNoPendingChanges reports whether err is Dyn rejecting a zone publish
+// because there is nothing to publish, either with an error status or in the
+// status of the response body.
+func isNoPendingChanges(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*DynStatusError); !ok && dynStatusCode(err) == 0 {
+		return false
+	}
+	for _, msg := range noPendingChangesMessages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// ttlNumberPattern matches the TTL in a Dyn message rejecting a record TTL.
+var ttlNumberPattern = regexp.MustCompile(`\d+`)
+
+// minimumTTL returns the zone minimum TTL from a Dyn message rejecting a
+// record TTL as too low, such as "ttl: TTL must be at least 300". It reports
+// false if err is not such a rejection or the minimum cannot be parsed.
+func minimumTTL(err error) (int, bool) {
+	for _, m := range dynMessages(err) {
+		info := strings.ToLower(m.Info)
+		if !strings.Contains(info, "ttl") || !(strings.Contains(info, "minimum") || strings.Contains(info, "at least")) {
+			continue
+		}
+		numbers := ttlNumberPattern.FindAllString(info, -1)
+		if len(numbers) == 0 {
+			continue
+		}
+		ttl, err := strconv.Atoi(numbers[len(numbers)-1])
+		if err != nil || ttl <= 0 || ttl > maxTTL {
+			continue
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// dynMessages returns the messages of the Dyn response reported by err, which
+// is either a DynStatusError or an error status returned by go-dynect.
+func dynMessages(err error) []dynect.MessageBlock {
+	var statusErr *DynStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Messages
+	}
+	if dynStatusCode(err) == 0 {
+		return nil
+	}
+
+	var resp dynect.ResponseBlock
+	msg := err.Error()
+	if i := strings.Index(msg, ": "); i < 0 || json.Unmarshal([]byte(msg[i+2:]), &resp) != nil {
+		return nil
+	}
+	return resp.Messages
+}
+
+// dynMessage returns the Dyn messages reported by err, or the error itself if
+// it does not carry any.
+func dynMessage(err error) string {
+	var msgs []string
+	for _, m := range dynMessages(err) {
+		if m.Info != "" {
+			msgs = append(msgs, m.Info)
+		}
+	}
+	if len(msgs) == 0 {
+		return err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// withDynMessages adds err to the log fields, along with the messages Dyn
+// returned describing it, such as "TTL below zone minimum", if there are any.
+func withDynMessages(fields logFields, err error) {
+	fields["error"] = err
+
+	var msgs []string
+	for _, m := range dynMessages(err) {
+		msg := m.Info
+		if m.ErrorCode != "" {
+			msg = m.ErrorCode + ": " + msg
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) > 0 {
+		fields["dyn_messages"] = msgs
+	}
+}
+
+// authenticationError wraps the error of a failed login in ErrAuthentication,
+// unless the login failed for a reason other than Dyn rejecting it.
+func authenticationError(err error) error {
+	if code := dynStatusCode(err); code < 400 || code >= 500 {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrAuthentication, dynMessage(err))
+}
+
+// authorizationError wraps err in ErrAuthorization if it is Dyn denying the
+// account permission for the request.
+func authorizationError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	denied := dynStatusCode(err) == 403
+	for _, m := range dynMessages(err) {
+		denied = denied || m.ErrorCode == "PERMISSION_DENIED"
+	}
+	if !denied {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrAuthorization, dynMessage(err))
+}
+
+// isNotFound reports whether err is Dyn reporting that nothing exists at the
+// requested link.
+func isNotFound(err error) bool {
+	return dynStatusCode(err) == 404
+}
+
+// isTransient reports whether err is a server side or network failure that
+// may succeed when the request is retried. Requests failed fast by the open
+// circuit breaker are not, since retrying them would fail fast again.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if code := dynStatusCode(err); code != 0 {
+		return code >= 500
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nesv/go-dynect/dynect"
+)
+
+func TestExpiredSessionIsRenewed(t *testing.T) {
+	dyn := newFakeDyn()
+	expired := false
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if r.Method == "PUT" && !expired {
+			expired = true
+			return dyn.respondJSON(http.StatusBadRequest, `{"status": "failure", "msgs": [{"INFO": "login: Bad or expired credentials", "ERR_CD": "INVALID_DATA"}]}`), nil
+		}
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	ch := newTestChallenge()
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if err := commit(solver, &cfg, ch); err != nil {
+		t.Fatalf("expected the publish to succeed after logging in again, got %v", err)
+	}
+
+	if logins := len(dyn.sent("POST Session")); logins != 2 {
+		t.Errorf("expected a second login after the session expired, got %d logins", logins)
+	}
+	if got := dyn.endpoints(); len(got) != 2 || dyn.publishes != 1 {
+		t.Errorf("expected the publish to be retried, got %v", got)
+	}
+}
+
+func TestZoneMinimumTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    string
+		wantTTL string
+		wantErr bool
+	}{
+		{name: "minimum parsed", info: "ttl: TTL must be at least 300", wantTTL: "300"},
+		{name: "minimum not parsed", info: "ttl: TTL below zone minimum", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			var ttls []string
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/REST/TXTRecord/") {
+					return nil, nil
+				}
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return nil, err
+				}
+				var req struct {
+					TTL string `json:"ttl"`
+				}
+				if err := json.Unmarshal(body, &req); err != nil {
+					return nil, err
+				}
+				ttls = append(ttls, req.TTL)
+				if ttl, _ := strconv.Atoi(req.TTL); ttl < 300 {
+					msg := fmt.Sprintf(`{"status": "failure", "msgs": [{"INFO": %q, "ERR_CD": "INVALID_DATA"}]}`, tt.info)
+					return dyn.respondJSON(http.StatusBadRequest, msg), nil
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+
+			err := solver.Present(withConfig(t, newTestChallenge(), map[string]interface{}{"maxRetries": -1}))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error when the zone minimum cannot be parsed")
+				}
+				if len(ttls) != 1 {
+					t.Errorf("expected a single create attempt, got TTLs %q", ttls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error presenting: %v", err)
+			}
+			if len(ttls) != 2 || ttls[1] != tt.wantTTL {
+				t.Errorf("expected the create to be retried with TTL %s, got TTLs %q", tt.wantTTL, ttls)
+			}
+			if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+				t.Errorf("expected the record to be created, got %q", got)
+			}
+		})
+	}
+}
+
+func TestCommitNoPendingChanges(t *testing.T) {
+	const noChanges = `{"status": "failure", "msgs": [{"INFO": "publish: No changes to publish", "ERR_CD": "NOT_FOUND", "LVL": "ERROR"}]}`
+	tests := []struct {
+		name string
+		code int
+	}{
+		{name: "failure status", code: http.StatusOK},
+		{name: "error status", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			dyn.failures = map[string]int{"PUT Zone/example.com/": tt.code}
+			dyn.responses = map[string]string{"PUT Zone/example.com/": noChanges}
+			solver := newTestSolver(dyn)
+
+			if err := solver.Present(newTestChallenge()); err != nil {
+				t.Errorf("expected a publish without pending changes to succeed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCommitFailureStatus(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.responses = map[string]string{
+		"PUT Zone/example.com/": `{"status": "failure", "msgs": [{"INFO": "publish: Zone is frozen", "ERR_CD": "OPERATION_FAILED", "LVL": "ERROR"}]}`,
+	}
+	solver := newTestSolver(dyn)
+	ch := newTestChallenge()
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	_, err = solver.createRecord(&cfg, ch)
+	var statusErr *DynStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a DynStatusError, got %v", err)
+	}
+	if statusErr.Status != "failure" {
+		t.Errorf("expected status failure, got %q", statusErr.Status)
+	}
+	if !strings.Contains(err.Error(), "publish: Zone is frozen") {
+		t.Errorf("expected the Dyn message in the error, got %q", err.Error())
+	}
+}
+
+func TestCommitFailedAfterCreate(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.failures = map[string]int{"PUT Zone/example.com/": http.StatusBadRequest}
+	solver := newTestSolver(dyn)
+
+	err := solver.Present(withConfig(t, newTestChallenge(), map[string]interface{}{"publishRetries": -1}))
+	var commitErr *CommitFailedAfterCreateError
+	if !errors.As(err, &commitErr) {
+		t.Fatalf("expected a CommitFailedAfterCreateError, got %v", err)
+	}
+	if commitErr.Zone != "example.com" || commitErr.Record != testRecordsLink || commitErr.Err == nil {
+		t.Errorf("unexpected error details %+v", commitErr)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+		t.Errorf("expected the created record to be left staged, got %v", got)
+	}
+
+	dyn.failures = map[string]int{"POST " + testRecordsLink: http.StatusBadRequest}
+	ch := newTestChallenge()
+	ch.Key = "other-key"
+	if err := solver.Present(ch); err == nil || errors.As(err, &commitErr) {
+		t.Errorf("expected a failed create not to be a CommitFailedAfterCreateError, got %v", err)
+	}
+}
+
+func TestRetryableErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "config", err: &ConfigError{Err: errors.New("bad config")}, want: false},
+		{name: "authentication", err: fmt.Errorf("%w: bad credentials", ErrAuthentication), want: false},
+		{name: "authorization", err: fmt.Errorf("%w: permission denied", ErrAuthorization), want: false},
+		{name: "missing secret key", err: &SecretKeyNotFoundError{Name: "dyndns", Namespace: "default", Key: "password"}, want: false},
+		{name: "bad request", err: errors.New("server responded with 400 Bad Request: {}"), want: false},
+		{name: "dyn status", err: &DynStatusError{Status: "failure", Messages: []dynect.MessageBlock{{Info: "rdata: invalid"}}}, want: false},
+		{name: "operation in progress", err: &DynStatusError{Status: "failure", Messages: []dynect.MessageBlock{{Info: "Operation blocked by current task"}}}, want: true},
+		{name: "rate limited", err: errors.New("server responded with 429 Too Many Requests: {}"), want: true},
+		{name: "server error", err: errors.New("server responded with 503 Service Unavailable: {}"), want: true},
+		{name: "unknown", err: io.ErrUnexpectedEOF, want: true},
+		{name: "commit failed", err: &CommitFailedAfterCreateError{Zone: "example.com", Err: &ConfigError{Err: errors.New("bad config")}}, want: true},
+		{name: "targets quorum reachable", err: &TargetsError{Total: 3, Quorum: 2, Errors: []error{
+			&ConfigError{Err: errors.New("bad config")},
+			errors.New("server responded with 503 Service Unavailable: {}"),
+		}}, want: true},
+		{name: "targets quorum unreachable", err: &TargetsError{Total: 3, Quorum: 2, Errors: []error{
+			&ConfigError{Err: errors.New("bad config")},
+			fmt.Errorf("target 1: %w", ErrAuthentication),
+		}}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := solverError(tt.err)
+			var retryable RetryableError
+			if !errors.As(err, &retryable) || retryable.IsRetryable() != tt.want {
+				t.Errorf("expected retryable %t, got %v", tt.want, err)
+			}
+			suffix := " (non-retryable)"
+			if tt.want {
+				suffix = " (retryable)"
+			}
+			if !strings.HasSuffix(err.Error(), suffix) {
+				t.Errorf("expected %q to end with %q", err, suffix)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected %v to wrap %v", err, tt.err)
+			}
+		})
+	}
+
+	solver := newTestSolver(newFakeDyn())
+	err := solver.Present(withConfig(t, newTestChallenge(), map[string]interface{}{"unknownField": true}))
+	var solverErr *SolverError
+	if !errors.As(err, &solverErr) || solverErr.Retryable {
+		t.Errorf("expected an invalid config to fail with a non-retryable SolverError, got %v", err)
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  map[string]int
+		responses map[string]string
+		want      error
+		wantMsg   string
+	}{
+		{
+			name:     "rejected credentials",
+			failures: map[string]int{"POST Session": http.StatusBadRequest},
+			responses: map[string]string{
+				"POST Session": `{"status": "failure", "msgs": [{"INFO": "login: Credentials you entered did not match those in our database", "ERR_CD": "INVALID_DATA"}]}`,
+			},
+			want:    ErrAuthentication,
+			wantMsg: "login: Credentials you entered did not match those in our database (check that customerName",
+		},
+		{
+			name:     "denied record change",
+			failures: map[string]int{"POST " + testRecordsLink: http.StatusForbidden},
+			responses: map[string]string{
+				"POST " + testRecordsLink: `{"status": "failure", "msgs": [{"INFO": "zone: No such zone in your account", "ERR_CD": "PERMISSION_DENIED"}]}`,
+			},
+			want:    ErrAuthorization,
+			wantMsg: "zone: No such zone in your account",
+		},
+		{
+			name: "denied publish",
+			responses: map[string]string{
+				"PUT Zone/example.com/": `{"status": "failure", "msgs": [{"INFO": "publish: You do not have permission to publish this zone", "ERR_CD": "PERMISSION_DENIED"}]}`,
+			},
+			want:    ErrAuthorization,
+			wantMsg: "publish: You do not have permission to publish this zone",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			dyn.failures = tt.failures
+			dyn.responses = tt.responses
+			solver := newTestSolver(dyn)
+
+			err := solver.Present(newTestChallenge())
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("expected the Dyn message %q in %q", tt.wantMsg, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source reported for the events of the webhook.
+const eventComponent = "cert-manager-webhook-dyndns"
+
+// newEventRecorder returns a recorder sending events through cl, and the
+// broadcaster that must be shut down once the webhook stops.
+func newEventRecorder(cl kubernetes.Interface) (record.EventRecorder, record.EventBroadcaster) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cl.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+	return recorder, broadcaster
+}
+
+// recordFailure records a warning event for the failed solver operation on
+// ch in the challenge's namespace, so that failures are visible to the
+// owners of the certificate. ChallengeRequest does not identify the
+// Challenge resource, so the event refers to its namespace.
+func (c *dynDNSProviderSolver) recordFailure(ch *v1alpha1.ChallengeRequest, reason string, err error) {
+	if c.recorder == nil || err == nil {
+		return
+	}
+
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       ch.ResourceNamespace,
+		Namespace:  ch.ResourceNamespace,
+	}
+	c.recorder.Eventf(ref, corev1.EventTypeWarning, reason, "Solving the DNS01 challenge for %s failed: %v", ch.ResolvedFQDN, err)
+}
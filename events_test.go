@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFailureEvents(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.failures = map[string]int{"POST Session": http.StatusBadRequest}
+	solver := newTestSolver(dyn)
+	recorder := record.NewFakeRecorder(2)
+	solver.recorder = recorder
+
+	ch := newTestChallenge()
+	if err := solver.Present(ch); err == nil {
+		t.Fatal("expected Present to fail")
+	}
+	if err := solver.CleanUp(ch); err == nil {
+		t.Fatal("expected CleanUp to fail")
+	}
+
+	for _, reason := range []string{"PresentFailed", "CleanUpFailed"} {
+		select {
+		case event := <-recorder.Events:
+			if !strings.HasPrefix(event, "Warning "+reason+" ") {
+				t.Errorf("expected a %s warning event, got %q", reason, event)
+			}
+		default:
+			t.Errorf("expected a %s event", reason)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// readinessCacheTTL is how long the result of a Dyn connectivity check is
+// reused, to avoid creating a Dyn session for every readiness probe.
+const readinessCacheTTL = 30 * time.Second
+
+// readinessCheck verifies that the Dyn API can be logged in to with the
+// credentials the deployment configured for the startup self-test. The
+// credentials of issuers are not checked, since one tenant's wrong password
+// must not make the webhook unready for all of them. Checks run in the
+// background, so that a slow or retried Dyn login never holds up the
+// readiness endpoint.
+type readinessCheck struct {
+	mu         sync.Mutex
+	checked    time.Time
+	refreshing bool
+	err        error
+}
+
+// check returns the result of the last connectivity check for cfg, starting
+// a new one in the background if the last result is too old. Without
+// credentials to check, or before the first check finished, the solver is
+// considered ready.
+func (r *readinessCheck) check(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cfg != nil && !r.refreshing && time.Since(r.checked) >= readinessCacheTTL {
+		r.refreshing = true
+		go r.refresh(c, cfg)
+	}
+	return r.err
+}
+
+// refresh runs a connectivity check for cfg and records its result.
+func (r *readinessCheck) refresh(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig) {
+	err := c.checkDynConnectivity(cfg, "")
+	if err != nil {
+		klog.Errorf("Dyn readiness check failed: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+	r.checked = time.Now()
+	r.refreshing = false
+}
+
+// checkDynConnectivity creates and immediately destroys a Dyn session for cfg.
+func (c *dynDNSProviderSolver) checkDynConnectivity(cfg *dynDNSProviderConfig, namespace string) error {
+	if err := c.validate(cfg); err != nil {
+		return &ConfigError{Err: err}
+	}
+
+	dynClient, err := c.login(cfg, namespace)
+	if err != nil {
+		return err
+	}
+	logout(dynClient, cfg.sessionPath())
+
+	return nil
+}
+
+// serveReadyz reports whether the startup self-test passed, if enabled, and
+// the Dyn API was reachable with the self-test credentials at the last check,
+// responding with 503 Service Unavailable if not.
+func (c *dynDNSProviderSolver) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := c.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// ready returns why the solver is not ready, if it is not.
+func (c *dynDNSProviderSolver) ready() error {
+	if err := c.selfTest.status(); err != nil {
+		return err
+	}
+	if err := c.readiness.check(c, c.canary); err != nil {
+		return fmt.Errorf("Dyn API unavailable: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCanaryConfig returns the config of a self-test against
+// canary.example.com, as set up by the deployment.
+func testCanaryConfig(t *testing.T) *dynDNSProviderConfig {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("canary-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"CANARY_ZONE":          "canary.example.com.",
+		"CANARY_USERNAME":      "canary-user",
+		"CANARY_CUSTOMER_NAME": "canary-customer",
+		"CANARY_PASSWORD_FILE": passwordFile,
+	}
+	return canaryConfigFromEnv(func(name string) string { return env[name] })
+}
+
+func TestReadyz(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.failures = map[string]int{"POST Session": http.StatusBadRequest}
+	solver := newTestSolver(dyn)
+
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		solver.serveReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+
+	if err := solver.Present(newTestChallenge()); err == nil {
+		t.Fatal("expected Present to fail without a Dyn session")
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("expected an issuer's failing credentials not to affect readiness, got %d", code)
+	}
+	if got := len(dyn.sent("POST Session")); got != 1 {
+		t.Errorf("expected only the issuer to log in without deployment credentials, got %d logins", got)
+	}
+
+	solver.canary = testCanaryConfig(t)
+	deadline := time.Now().Add(5 * time.Second)
+	for readyz() != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("expected not to be ready when logging in with the canary credentials fails")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, payload := range dyn.sent("POST Session")[1:] {
+		if !strings.Contains(payload, "canary-user") {
+			t.Errorf("expected the readiness check to log in as the canary user, got %s", payload)
+		}
+	}
+}
+
+func TestReadyzDoesNotWaitForLogin(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	solver.canary = testCanaryConfig(t)
+
+	release := make(chan struct{})
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if r.Method == "POST" && r.URL.Path == "/REST/Session" {
+			<-release
+		}
+		return nil, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		done := make(chan int)
+		go func() {
+			rec := httptest.NewRecorder()
+			solver.serveReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+			done <- rec.Code
+		}()
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("expected the last result while logging in, got %d", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the readiness endpoint not to wait for the Dyn login")
+		}
+	}
+
+	// Let the background check finish before other tests log.
+	close(release)
+	for refreshing := true; refreshing; time.Sleep(time.Millisecond) {
+		solver.readiness.mu.Lock()
+		refreshing = solver.readiness.refreshing
+		solver.readiness.mu.Unlock()
+	}
+}
+
+func TestReadyzCheck(t *testing.T) {
+	solver := newTestSolver(newFakeDyn())
+	check := solver.readyzCheck()
+	if check.Name() != "dyndns" {
+		t.Errorf("expected the check to be named dyndns, got %q", check.Name())
+	}
+	if err := check.Check(nil); err != nil {
+		t.Errorf("expected to be ready without a self-test, got %v", err)
+	}
+
+	solver.selfTest.enabled = true
+	if err := check.Check(nil); err == nil {
+		t.Error("expected not to be ready while the self-test is pending")
+	}
+}
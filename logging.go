@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// logJSON switches the solver's operation logs from klog's human readable
+// output to one JSON object per line. It is set from LOG_FORMAT=json.
+var logJSON bool
+
+// logOutput is where JSON log lines are written.
+var logOutput io.Writer = os.Stderr
+
+// logOutputMu serialises writes of JSON log lines.
+var logOutputMu sync.Mutex
+
+// logFields are the key/value pairs attached to a log line, such as zone,
+// fqdn, key, operation, duration and error.
+type logFields map[string]interface{}
+
+// challengeRequestID returns the ID tying together the log lines of the
+// Present, commit and CleanUp calls for ch. It is derived from the namespace,
+// FQDN and key of the challenge, so that it is the same for all of them.
+func challengeRequestID(ch *v1alpha1.ChallengeRequest) string {
+	sum := sha256.Sum256([]byte(ch.ResourceNamespace + "/" + trimDot(ch.ResolvedFQDN) + "/" + ch.Key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// logFields returns fields with the request ID of cfg added, if it has one.
+func (cfg *dynDNSProviderConfig) logFields(fields logFields) logFields {
+	if cfg.requestID != "" {
+		fields["request_id"] = cfg.requestID
+	}
+	return fields
+}
+
+// logInfo logs msg with fields at info level.
+func logInfo(msg string, fields logFields) {
+	logEntry("info", msg, fields)
+}
+
+// logVerbose logs msg with fields at debug level when the klog verbosity is
+// at least 2. It is meant for the routine steps of successful operations,
+// which would flood the logs during mass renewals at info level.
+func logVerbose(msg string, fields logFields) {
+	if klog.V(2).Enabled() {
+		logEntry("debug", msg, fields)
+	}
+}
+
+// logDebug logs msg with fields at debug level when the klog verbosity is at
+// least 4.
+func logDebug(msg string, fields logFields) {
+	if klog.V(4).Enabled() {
+		logEntry("debug", msg, fields)
+	}
+}
+
+// logError logs msg with fields at error level.
+func logError(msg string, fields logFields) {
+	logEntry("error", msg, fields)
+}
+
+func logEntry(level, msg string, fields logFields) {
+	if !logJSON {
+		text := msg + formatFields(fields)
+		if level == "error" {
+			klog.ErrorDepth(2, text)
+		} else {
+			klog.InfoDepth(2, text)
+		}
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		entry[k] = jsonValue(v)
+	}
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		klog.Errorf("Error encoding log entry %q: %v", msg, err)
+		return
+	}
+
+	logOutputMu.Lock()
+	defer logOutputMu.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
+
+// formatFields renders fields as sorted key=value pairs for klog.
+func formatFields(fields logFields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+	return b.String()
+}
+
+// jsonValue converts values that do not encode usefully to JSON: errors are
+// logged by message and durations in seconds.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.Seconds()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestJSONLogging(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	logError("Error creating record", logFields{
+		"zone":     "example.com",
+		"fqdn":     "_acme-challenge.example.com.",
+		"duration": 1500 * time.Millisecond,
+		"error":    errors.New("boom"),
+	})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(out.String()), &entry); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", out.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":    "error",
+		"msg":      "Error creating record",
+		"zone":     "example.com",
+		"fqdn":     "_acme-challenge.example.com.",
+		"duration": 1.5,
+		"error":    "boom",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestLogDynMessages(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	dyn := newFakeDyn()
+	dyn.failures = map[string]int{"POST " + testRecordsLink: http.StatusBadRequest}
+	dyn.responses = map[string]string{
+		"POST " + testRecordsLink: `{"status": "failure", "msgs": [{"INFO": "ttl: TTL below zone minimum", "ERR_CD": "INVALID_DATA"}]}`,
+	}
+	solver := newTestSolver(dyn)
+
+	if err := solver.Present(newTestChallenge()); err == nil {
+		t.Fatal("expected an error creating the record")
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry struct {
+			Msg         string   `json:"msg"`
+			DynMessages []string `json:"dyn_messages"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry.Msg != "Error creating record" {
+			continue
+		}
+		if want := "INVALID_DATA: ttl: TTL below zone minimum"; len(entry.DynMessages) != 1 || entry.DynMessages[0] != want {
+			t.Errorf("expected dyn_messages [%q], got %q", want, entry.DynMessages)
+		}
+		return
+	}
+	t.Errorf("expected an error creating the record to be logged, got %q", out.String())
+}
+
+// setVerbosity sets the -v flag of the webhook command to level for the
+// duration of the test.
+func setVerbosity(t *testing.T, level int) {
+	fs := pflag.NewFlagSet("webhook", pflag.ContinueOnError)
+	fs.AddGoFlagSet(flag.CommandLine)
+	if err := fs.Parse([]string{"--v=" + strconv.Itoa(level)}); err != nil {
+		t.Fatalf("unexpected error setting the verbosity: %v", err)
+	}
+	t.Cleanup(func() { fs.Set("v", "0") })
+}
+
+func TestVerbosityFlag(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	tests := []struct {
+		level       int
+		wantVerbose bool
+		wantDebug   bool
+	}{
+		{level: 0},
+		{level: 2, wantVerbose: true},
+		{level: 4, wantVerbose: true, wantDebug: true},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		setVerbosity(t, tt.level)
+		logVerbose("verbose line", logFields{})
+		logDebug("debug line", logFields{})
+		if got := strings.Contains(out.String(), "verbose line"); got != tt.wantVerbose {
+			t.Errorf("-v=%d: expected verbose lines to be logged %t, got %q", tt.level, tt.wantVerbose, out.String())
+		}
+		if got := strings.Contains(out.String(), "debug line"); got != tt.wantDebug {
+			t.Errorf("-v=%d: expected debug lines to be logged %t, got %q", tt.level, tt.wantDebug, out.String())
+		}
+	}
+}
+
+func TestQuietSuccessfulChallenges(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	solver := newTestSolver(newFakeDyn())
+	if err := solver.Present(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	if err := solver.CleanUp(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry struct {
+			Msg string `json:"msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		msgs = append(msgs, entry.Msg)
+	}
+	if want := []string{"Presented challenge", "Cleaned up challenge"}; strings.Join(msgs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected only the summary lines at the default verbosity\ngot:  %q\nwant: %q", msgs, want)
+	}
+}
+
+func TestLogDynAPICalls(t *testing.T) {
+	setVerbosity(t, 2)
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	if err := newTestSolver(newFakeDyn()).Present(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	calls := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry struct {
+			Level     string   `json:"level"`
+			Msg       string   `json:"msg"`
+			Operation string   `json:"operation"`
+			Endpoint  string   `json:"endpoint"`
+			Duration  *float64 `json:"duration"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry.Msg != "Dyn API call" {
+			continue
+		}
+		if entry.Level != "debug" || entry.Duration == nil {
+			t.Errorf("expected a debug line with the duration, got %q", line)
+		}
+		calls[entry.Operation+" "+entry.Endpoint] = true
+	}
+	for _, want := range []string{"POST TXTRecord " + testRecordsLink, "PUT Zone Zone/example.com/"} {
+		if !calls[want] {
+			t.Errorf("expected the call %q to be logged, got %v", want, calls)
+		}
+	}
+}
+
+func TestLogOrphanedRecord(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	if err := solver.Present(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	dyn.failures = map[string]int{"PUT Zone/example.com/": http.StatusBadRequest}
+	if err := solver.CleanUp(newTestChallenge()); err == nil {
+		t.Fatal("expected an error cleaning up")
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry["msg"] != "Challenge record may have been left behind" {
+			continue
+		}
+		if entry["fqdn"] != "_acme-challenge.example.com" || entry["key"] != "challenge-key" {
+			t.Errorf("expected the orphaned record to be identified, got %q", line)
+		}
+		return
+	}
+	t.Errorf("expected the orphaned record to be logged, got %q", out.String())
+}
+
+func TestOrphanedRecordsOnlyAfterLookup(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+	orphans := func() int {
+		return strings.Count(out.String(), "Challenge record may have been left behind")
+	}
+
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	if err := solver.Present(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+
+	invalid := withConfig(t, newTestChallenge(), map[string]interface{}{"ttl": 1})
+	if err := solver.CleanUp(invalid); err == nil {
+		t.Fatal("expected an invalid config to fail")
+	}
+	if got := orphans(); got != 0 {
+		t.Errorf("expected an invalid config not to count as an orphaned record, got %d", got)
+	}
+
+	dyn.failures = map[string]int{"DELETE " + testRecordLink: http.StatusBadRequest}
+	if err := solver.CleanUp(newTestChallenge()); err == nil {
+		t.Fatal("expected the delete to fail")
+	}
+	if got := orphans(); got != 1 {
+		t.Errorf("expected a failed delete to count as an orphaned record, got %d", got)
+	}
+}
+
+func TestLogRequestID(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	solver := newTestSolver(newFakeDyn())
+	ch := newTestChallenge()
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	if err := solver.CleanUp(ch); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+
+	want := challengeRequestID(ch)
+	other := newTestChallenge()
+	other.Key = "other-key"
+	if challengeRequestID(other) == want {
+		t.Errorf("expected challenges with different keys to have different request IDs")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		// Sessions are destroyed once no challenge is using them.
+		if entry["endpoint"] == "Session" && entry["operation"] == "DELETE Session" {
+			continue
+		}
+		if entry["request_id"] != want {
+			t.Errorf("expected request_id %q, got %q", want, line)
+		}
+	}
+}
+
+func TestLoginLogging(t *testing.T) {
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+	setVerbosity(t, 2)
+
+	tests := []struct {
+		name      string
+		failures  map[string]int
+		wantMsg   string
+		wantLevel string
+	}{
+		{name: "success", wantMsg: "Created Dyn session", wantLevel: "debug"},
+		{name: "failure", failures: map[string]int{"POST Session": http.StatusBadRequest}, wantMsg: "Error creating Dyn session", wantLevel: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.Reset()
+			dyn := newFakeDyn()
+			dyn.failures = tt.failures
+			newTestSolver(dyn).Present(newTestChallenge())
+
+			var found bool
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("log line %q is not JSON: %v", line, err)
+				}
+				if entry["msg"] != tt.wantMsg {
+					continue
+				}
+				found = true
+				if entry["level"] != tt.wantLevel || entry["operation"] != "login" {
+					t.Errorf("expected a %s line for the login operation, got %q", tt.wantLevel, line)
+				}
+			}
+			if !found {
+				t.Errorf("expected %q to be logged, got %q", tt.wantMsg, out.String())
+			}
+		})
+	}
+}
@@ -1,37 +1,177 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
 
-	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/klog"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
 
 	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
-	"github.com/jetstack/cert-manager/pkg/acme/webhook/cmd"
-	certmanagerv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1alpha1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/nesv/go-dynect/dynect"
+	"golang.org/x/time/rate"
 )
 
 var GroupName = os.Getenv("GROUP_NAME")
 
+// version is the webhook version, set at build time with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
 func main() {
-	if GroupName == "" {
-		panic("GROUP_NAME must be specified")
+	if len(os.Args) > 1 && os.Args[1] == testCommand {
+		if err := runTestCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if path, ok := flagValue(os.Args[1:], "config"); ok {
+		if err := applyConfigFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	groupName, err := resolveGroupName(os.Args[1:], os.Getenv("GROUP_NAME"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	GroupName = groupName
+	solverName := resolveSolverName(os.Args[1:], os.Getenv("SOLVER_NAME"))
+	// Register --config, --group-name and --solver-name so that the webhook
+	// server, which adds the flags of flag.CommandLine to its own, accepts
+	// them.
+	flag.String("config", "", "A JSON file with defaults for the environment variables.")
+	flag.String("group-name", "", "The API group name of the solver. Overrides GROUP_NAME.")
+	flag.String("solver-name", "", "The name issuers refer to the solver by. Overrides SOLVER_NAME.")
+
+	logJSON = os.Getenv("LOG_FORMAT") == "json"
+	// Issuers may override the API endpoint with apiEndpoint, which is then
+	// logged with their challenges.
+	logInfo("Starting webhook", logFields{
+		"version":              version,
+		"go_dynect_version":    moduleVersion(dynectModule),
+		"default_api_endpoint": dynect.DynAPIPrefix,
+	})
+
+	solver := &dynDNSProviderSolver{
+		name:          solverName,
+		zoneAllowlist: splitList(os.Getenv("ZONE_ALLOWLIST")),
+		clusterID:     os.Getenv("CLUSTER_ID"),
+		// Issuers may only name credential files in this directory.
+		credentialsDir: os.Getenv("CREDENTIALS_DIR"),
+		canary:         canaryConfigFromEnv(os.Getenv),
+	}
+	// Report the webhook as not ready until the self-test, started once the
+	// solver is initialized, has passed.
+	solver.selfTest.enabled = solver.canary != nil
+	if skip, _ := strconv.ParseBool(os.Getenv("DISABLE_PROPAGATION_SLEEP")); skip {
+		solver.skipPropagationDelay = true
+		logInfo("Propagation delay disabled by DISABLE_PROPAGATION_SLEEP", logFields{})
+	}
+
+	registerMetrics()
+	startAuxiliary(solver)
 
 	// This will register our custom DNS provider with the webhook serving
 	// library, making it available as an API under the provided GroupName.
-	cmd.RunWebhookServer(GroupName,
-		&dynDNSProviderSolver{},
-	)
+	runWebhookServer(GroupName, solver)
+}
+
+// dynectModule is the module path of the Dyn API client library.
+const dynectModule = "github.com/nesv/go-dynect"
+
+// moduleVersion returns the version of the module dependency at path compiled
+// into the binary, or "unknown" if it cannot be determined.
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return "unknown"
+}
+
+// resolveGroupName returns the group name given by the --group-name flag in
+// args, falling back to env.
+func resolveGroupName(args []string, env string) (string, error) {
+	name := env
+	if v, ok := flagValue(args, "group-name"); ok {
+		name = v
+	}
+	if name == "" {
+		return "", errors.New("a group name must be specified with --group-name or GROUP_NAME")
+	}
+	return name, nil
+}
+
+// resolveSolverName returns the solver name given by the --solver-name flag
+// in args, falling back to env and then to defaultSolverName.
+func resolveSolverName(args []string, env string) string {
+	name := env
+	if v, ok := flagValue(args, "solver-name"); ok {
+		name = v
+	}
+	if name == "" {
+		return defaultSolverName
+	}
+	return name
+}
+
+// flagValue returns the value of the last --name flag in args. Flags are
+// looked up by hand because the webhook server only parses the command line
+// once the solver has been created.
+func flagValue(args []string, name string) (string, bool) {
+	var value string
+	var found bool
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if v := strings.TrimPrefix(arg, "--"+name+"="); v != arg {
+			value, found = v, true
+		} else if arg == "--"+name && i+1 < len(args) {
+			value, found = args[i+1], true
+			i++
+		}
+	}
+	return value, found
 }
 
 // customDNSProviderSolver implements the provider-specific logic needed to
@@ -39,11 +179,145 @@ func main() {
 // To do so, it must implement the `github.com/jetstack/cert-manager/pkg/acme/webhook.Solver`
 // interface.
 type dynDNSProviderSolver struct {
-	client *kubernetes.Clientset
+	client kubernetes.Interface
+
+	// name is the name issuers refer to the solver by. Defaults to
+	// defaultSolverName when empty.
+	name string
+
+	// clusterID identifies the cluster in the User-Agent of Dyn API
+	// requests. It is set from CLUSTER_ID.
+	clusterID string
+
+	// credentialsDir is the directory issuers may name usernameFile and
+	// passwordFile in. It is set from CREDENTIALS_DIR, and issuers may not
+	// name any files when it is empty.
+	credentialsDir string
+
+	// zoneAllowlist, when set, is the only zones any issuer may change. It
+	// is set from ZONE_ALLOWLIST, so that it cannot be widened by issuers.
+	zoneAllowlist []string
+
+	// transport, when set, is used by the Dyn clients instead of the default
+	// HTTP transport.
+	transport http.RoundTripper
+
+	// transports caches the HTTP transports of the Dyn clients by their
+	// settings, so that connections to Dyn are reused across sessions.
+	transportsMu sync.Mutex
+	transports   map[string]*cachedTransport
+
+	// newDynClient, when set, creates the Dyn clients instead of
+	// newDynectClient. Clients it returns are not yet logged in.
+	newDynClient func(cfg *dynDNSProviderConfig) (dynClientInterface, error)
+
+	// sessions caches logged in Dyn clients keyed by sessionKey, so that a
+	// single session is shared between Present, CleanUp and commit instead
+	// of logging in for every API call. sessionUsers counts the Present and
+	// CleanUp calls currently using each session, so that the session is
+	// only destroyed once the last of them finishes. logins holds the logins
+	// in flight, which concurrent calls for the same key wait for. pools
+	// holds the session pools by accountKey of the accounts whose configs
+	// set MaxSessions, which are used instead of the shared session.
+	sessionsMu   sync.Mutex
+	sessions     map[string]*dynSession
+	sessionUsers map[string]int
+	logins       map[string]*loginCall
+	pools        map[string]*sessionPool
+
+	// sharedRecords tracks the challenges presented at each record name
+	// for SharedRecordCleanup.
+	sharedMu      sync.Mutex
+	sharedRecords map[string]*sharedRecord
+
+	// zoneLocks holds a *sync.Mutex per zone name, serialising publishes of
+	// the same zone since Dyn rejects overlapping publish operations.
+	zoneLocks sync.Map
+
+	// pendingCommits holds the batched publishes waiting for the debounce
+	// window to pass, by batchKey.
+	pendingMu      sync.Mutex
+	pendingCommits map[string]*pendingCommit
+
+	// readiness checks Dyn API connectivity with the canary credentials for
+	// the /readyz endpoint.
+	readiness readinessCheck
+
+	// activity records the last publish of every zone for the /status
+	// endpoint.
+	activity zoneActivity
+
+	// canary is the solver config of the startup self-test, which is run
+	// once Initialize has set up the Kubernetes client, or nil if disabled.
+	canary *dynDNSProviderConfig
+	// selfTest holds the result of the startup self-test, which the
+	// /readyz endpoint waits for when it is enabled.
+	selfTest selfTest
+
+	// limiters rate limit the requests of the Dyn clients of every customer
+	// account, since Dyn enforces its rate limits per account. They are
+	// keyed by rateLimiterKey.
+	limitersMu sync.Mutex
+	limiters   map[string]*rate.Limiter
+
+	// breakers hold the circuit breaker of every Dyn API endpoint, keyed by
+	// circuitBreakerKey.
+	breakersMu sync.Mutex
+	breakers   map[string]*circuitBreaker
+
+	// secrets caches the secrets referenced by solver configs. Secrets are
+	// read from the API server directly when it is nil.
+	secrets *secretCache
+
+	// skipPropagationDelay skips waiting for the propagation delay after
+	// publishing the zone. It is set from DISABLE_PROPAGATION_SLEEP, for
+	// test clusters running against a mock Dyn API.
+	skipPropagationDelay bool
+
+	// stopCh is closed when the webhook shuts down, which cancels waiting
+	// for records to propagate.
+	stopCh <-chan struct{}
+
+	// rand jitters the propagation delay. It is seeded from the clock when
+	// first used, unless tests set it to a seeded source.
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// lookupCNAME, when set, resolves CNAMEs for FollowDelegation instead of
+	// the default resolver.
+	lookupCNAME func(ctx context.Context, host string) (string, error)
+
+	// recorder records Kubernetes events for failed challenges. No events
+	// are recorded when it is nil.
+	recorder record.EventRecorder
+}
+
+// defaultSolverName is the name of the solver when no other is configured.
+const defaultSolverName = "dyndns"
+
+// dynSessionTTL is how long a cached Dyn session is reused. Dyn expires
+// sessions after 60 minutes of inactivity, so stay comfortably below that.
+const dynSessionTTL = 50 * time.Minute
+
+// dynSession is a logged in Dyn client together with the time after which
+// its token should no longer be reused, and a hash of the password it logged
+// in with, which callers must present to reuse it.
+type dynSession struct {
+	client       dynClientInterface
+	path         string
+	expires      time.Time
+	passwordHash [sha256.Size]byte
+}
+
+// loginCall is a login in flight for a session key.
+type loginCall struct {
+	done    chan struct{}
+	session *dynSession
+	err     error
 }
 
-// ZonePublishRequest is missing from dynect but the notes field is a nice place to let
-// external-dns report some internal info during commit
+// ZonePublishRequest is missing from dynect but the notes field is a nice place to
+// record which webhook made the change during commit
 type ZonePublishRequest struct {
 	Publish bool   `json:"publish"`
 	Notes   string `json:"notes"`
@@ -60,71 +334,734 @@ type ZonePublishResponse struct {
 // additional configuration that's needed to solve the challenge for this
 // particular certificate or issuer.
 type dynDNSProviderConfig struct {
-	Username          string                          `json:"username"`
-	PasswordSecretRef certmanagerv1.SecretKeySelector `json:"passwordSecretRef"`
-	CustomerName      string                          `json:"customerName"`
-	ZoneName          string                          `json:"zonename"`
+	Username string `json:"username"`
+	// UsernameSecretRef selects a secret key holding the username. It takes
+	// precedence over Username.
+	UsernameSecretRef cmmeta.SecretKeySelector `json:"usernameSecretRef"`
+	// UsernameFile is the path of a file in the webhook pod holding the
+	// username, such as one written by a Vault agent. It takes precedence
+	// over Username, but not over UsernameSecretRef. Like PasswordFile, it
+	// must be within the credentials directory of the webhook.
+	UsernameFile      string                   `json:"usernameFile"`
+	PasswordSecretRef cmmeta.SecretKeySelector `json:"passwordSecretRef"`
+	// PasswordFile is the path of a file in the webhook pod holding the
+	// password. It is only used when PasswordSecretRef is not set.
+	PasswordFile string `json:"passwordFile"`
+	// CredentialsSecretRef names a secret holding the username, customer
+	// name and password under the keys credentialsUsernameKey,
+	// credentialsCustomerNameKey and credentialsPasswordKey. It takes
+	// precedence over all other credential fields.
+	CredentialsSecretRef cmmeta.LocalObjectReference `json:"credentialsSecretRef"`
+	CustomerName         string                      `json:"customerName"`
+	// ZoneName is the Dyn zone to publish. Defaults to the zone cert-manager
+	// resolved for the challenge.
+	ZoneName string `json:"zonename"`
+	// Zones lists the Dyn zones the issuer solves challenges in, sharing the
+	// same credentials. The zone containing the challenge FQDN is used when
+	// ZoneName is not set.
+	Zones []dynZoneConfig `json:"zones"`
+	// TTL is the TTL in seconds of the challenge TXT record, unless the zone
+	// sets its own. Defaults to defaultTTL when unset.
+	TTL int `json:"ttl"`
+	// APIEndpoint overrides the Dyn API base URL, which defaults to
+	// https://api.dynect.net/REST.
+	APIEndpoint string `json:"apiEndpoint"`
+	// Targets are the Dyn accounts and zones the challenge record is written
+	// to, such as those of redundant Dyn contracts, instead of the single
+	// account configured by the other fields. See dynTarget.
+	Targets []dynTarget `json:"targets"`
+	// TargetQuorum is how many of Targets the challenge has to succeed for.
+	// Defaults to all of them.
+	TargetQuorum int `json:"targetQuorum"`
+	// ProxyURL is the HTTP(S) proxy the Dyn API is reached through, and may
+	// include credentials. Defaults to the proxy configured by the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL string `json:"proxyURL"`
+	// DialNetwork is the network connections to the Dyn API are dialed on:
+	// tcp4 or tcp6 to only use IPv4 or IPv6, or tcp for either. Defaults to
+	// tcp.
+	DialNetwork string `json:"dialNetwork"`
+	// MaxIdleConns and MaxIdleConnsPerHost bound the idle connections kept
+	// open to the Dyn API for reuse, and IdleConnTimeout how long they are
+	// kept. They default to defaultMaxIdleConns,
+	// defaultMaxIdleConnsPerHost and defaultIdleConnTimeout when unset.
+	MaxIdleConns        int      `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int      `json:"maxIdleConnsPerHost"`
+	IdleConnTimeout     duration `json:"idleConnTimeout"`
+	// ClientCertSecretRef names a kubernetes.io/tls secret whose certificate
+	// is presented when connecting to the Dyn API, for proxies requiring
+	// mutual TLS. A CA certificate under ca.crt is trusted in addition to the
+	// system roots.
+	ClientCertSecretRef cmmeta.LocalObjectReference `json:"clientCertSecretRef"`
+	// Headers are added to every Dyn API request, for example to attribute
+	// API usage to a cluster. They do not replace the headers of the client.
+	Headers map[string]string `json:"headers"`
+	// clientTLS is the TLS config loaded from ClientCertSecretRef.
+	clientTLS *tls.Config
+	// clientTLSSecret is the namespace and name of the secret clientTLS was
+	// loaded from, and clientTLSHash a hash of its contents, which identify
+	// the HTTP transport presenting the certificate.
+	clientTLSSecret string
+	clientTLSHash   string
+	// requestID identifies the challenge the config was loaded for in log
+	// lines. It is set by Present and CleanUp.
+	requestID string
+	// trustedFiles is set for configs from the deployment rather than an
+	// issuer, whose credential files may be anywhere.
+	trustedFiles bool
+	// namespace is the namespace of the challenge the config was loaded
+	// for, which its secrets are read from. It is set by Present and CleanUp.
+	namespace string
+	// session is the pooled Dyn session handed to the Present or CleanUp
+	// the config was loaded for, if MaxSessions is set.
+	session *dynSession
+	// MaxRetries is how often a failed Dyn API request is retried when the
+	// failure is transient. Defaults to defaultMaxRetries when unset, a
+	// negative value disables retries.
+	MaxRetries int `json:"maxRetries"`
+	// ConfirmPublish makes every zone publish wait until the zone serial has
+	// increased, confirming the change is live, checking every
+	// propagationCheckInterval.
+	ConfirmPublish bool `json:"confirmPublish"`
+	// ConfirmPublishTimeout bounds the wait of ConfirmPublish. Defaults to
+	// defaultConfirmPublishTimeout when unset.
+	ConfirmPublishTimeout duration `json:"confirmPublishTimeout"`
+	// LoginRetries is how often creating a Dyn session is retried when it
+	// fails transiently, such as with a 5xx response. Rejected credentials
+	// are never retried. Defaults to defaultLoginRetries when zero, and
+	// disables retries when negative.
+	LoginRetries int `json:"loginRetries"`
+	// PublishRetries is how often a zone publish is retried while Dyn
+	// reports another operation in progress on the zone. Defaults to
+	// defaultPublishRetries when unset, a negative value disables retries.
+	PublishRetries int `json:"publishRetries"`
+	// RetryBaseDelay is the delay before the first retry, which doubles with
+	// every further attempt. Defaults to defaultRetryBaseDelay when unset.
+	RetryBaseDelay duration `json:"retryBaseDelay"`
+	// PropagationDelay is how long Present waits after publishing the zone,
+	// give or take a random propagationJitter. Defaults to
+	// defaultPropagationDelay when unset.
+	PropagationDelay duration `json:"propagationDelay"`
+	// PropagationCheckRetries, when set, replaces the propagation delay by
+	// checking that the record is present after publishing the zone, and
+	// checking again up to this many times until it is.
+	PropagationCheckRetries int `json:"propagationCheckRetries"`
+	// PropagationCheckInterval is the delay between propagation checks.
+	// Defaults to defaultPropagationCheckInterval when unset.
+	PropagationCheckInterval duration `json:"propagationCheckInterval"`
+	// RequestTimeout bounds every individual Dyn API request. Defaults to
+	// defaultRequestTimeout when unset.
+	RequestTimeout duration `json:"requestTimeout"`
+	// CreateTimeout, DeleteTimeout and PublishTimeout bound the requests
+	// creating or updating, deleting records and publishing zones instead
+	// of RequestTimeout, which they default to when unset.
+	CreateTimeout  duration `json:"createTimeout"`
+	DeleteTimeout  duration `json:"deleteTimeout"`
+	PublishTimeout duration `json:"publishTimeout"`
+	// CommitDebounce, when set, delays publishing the zone by this long so
+	// that record changes staged in the meantime are published together.
+	// Zones are published immediately by default.
+	CommitDebounce duration `json:"commitDebounce"`
+	// CommitNotesTemplate is a text/template rendering the notes recorded
+	// with every zone publish. See commitNotesData for the available fields.
+	CommitNotesTemplate string `json:"commitNotesTemplate"`
+	// DiscardPendingOnStart discards the zone's pending changes before a
+	// record is created, so that changes orphaned by an earlier failed
+	// publish are not published along with it. Changes staged by other
+	// challenges in flight for the same zone and session are discarded too.
+	DiscardPendingOnStart bool `json:"discardPendingOnStart"`
+	// RequestsPerSecond limits the rate of Dyn API requests made by the
+	// webhook for the customer account. Requests are not limited when unset.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// CircuitBreakerThreshold is how many Dyn API requests in a row may fail
+	// before further requests fail fast with ErrCircuitOpen for
+	// CircuitBreakerCooldown, which defaults to
+	// defaultCircuitBreakerCooldown. The breaker is disabled when unset.
+	CircuitBreakerThreshold int      `json:"circuitBreakerThreshold"`
+	CircuitBreakerCooldown  duration `json:"circuitBreakerCooldown"`
+	// VerifyBeforeCommit reads the TXT record back after creating it and
+	// fails before publishing the zone if it does not hold the challenge key.
+	VerifyBeforeCommit bool `json:"verifyBeforeCommit"`
+	// UpdateInPlace makes Present replace the value of the only TXT record
+	// at the challenge name, such as one left over from a previous renewal,
+	// instead of adding a record next to it. It must not be set for names
+	// with concurrent challenges, such as a certificate for both
+	// example.com and *.example.com, since one challenge would replace the
+	// value of the other.
+	UpdateInPlace bool `json:"updateInPlace"`
+	// SharedRecordCleanup defers publishing the deletion of a challenge
+	// record while other challenges are presented at the same name, so that
+	// the zone is published once the last of them is cleaned up. The
+	// challenges are tracked in memory, so deletions deferred when the
+	// webhook restarts are lost, and a challenge not presented again or
+	// cleaned up within an hour stops deferring the publish.
+	SharedRecordCleanup bool `json:"sharedRecordCleanup"`
+	// AutoCommit publishes the zone after every record change, and defaults
+	// to true. When false, records are created and deleted but left staged
+	// for whatever else publishes the zone, such as external-dns, so that
+	// its changesets are not published half-way. The challenge record is
+	// then not served until that happens, which may fail the challenge if
+	// the zone is not published within cert-manager's propagation checks.
+	AutoCommit *bool `json:"autoCommit"`
+	// RecordNameMappings rewrite the challenge names validated by the ACME
+	// server to the names the records are created at in Dyn, for
+	// split-horizon setups in which the zone addressed in the Dyn API is not
+	// the one validated against. The Dyn zone must then be configured with
+	// zonename or zones, since the resolved zone is the validated one.
+	RecordNameMappings []recordNameMapping `json:"recordNameMappings"`
+	// FollowDelegation places the challenge record at the target of a CNAME
+	// delegating the challenge name, such as to a dedicated validation zone,
+	// rather than at the challenge name. The target's zone must then be
+	// configured with zonename or zones.
+	FollowDelegation bool `json:"followDelegation"`
+	// SessionPath is the API path, relative to the API endpoint, at which
+	// Dyn sessions are created and destroyed. Defaults to
+	// defaultSessionPath, and only needs to be set for Dyn compatible
+	// gateways that expose sessions elsewhere.
+	SessionPath string `json:"sessionPath"`
+	// MaxSessions, when set, gives every Present and CleanUp a Dyn session
+	// of its own from a pool of at most this many sessions per account,
+	// rather than sharing a single session between them. An account is
+	// identified by its API endpoint, customer name and username, and its
+	// idle sessions count towards the limit. Calls wait up to
+	// SessionWaitTimeout for a session when all are in use. The first
+	// config using an account sets the size of its pool.
+	MaxSessions int `json:"maxSessions"`
+	// SessionWaitTimeout bounds waiting for a pooled session. Defaults to
+	// defaultSessionWaitTimeout when unset.
+	SessionWaitTimeout duration `json:"sessionWaitTimeout"`
+	// MaxRecordsPerName, when set, makes CleanUp refuse to delete anything
+	// if more TXT records than this exist at the challenge name, in case the
+	// zone holds records that were not expected there. Unlimited by default.
+	MaxRecordsPerName int `json:"maxRecordsPerName"`
+	// ZoneAllowlist, when set, is the only zones the issuer may change.
+	// Changes to other zones are denied before any request is made.
+	ZoneAllowlist []string `json:"zoneAllowlist"`
+	// SkipCleanup makes CleanUp leave the challenge record in place, so that
+	// it can be inspected when diagnosing a failed challenge. This is for
+	// debugging only: the records accumulate in the zone until they are
+	// deleted by hand.
+	SkipCleanup bool `json:"skipCleanup"`
+	// DryRun logs the record changes and zone publishes that would be made
+	// instead of making them. Records are still looked up.
+	DryRun bool `json:"dryRun"`
+}
+
+// dynZoneConfig configures one of several Dyn zones handled by an issuer.
+type dynZoneConfig struct {
+	Name string `json:"name"`
+	// TTL overrides the TTL of the challenge records in the zone.
+	TTL int `json:"ttl"`
+}
+
+// recordNameMapping maps the names under the From domain to the same names
+// under the To domain.
+type recordNameMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// apply returns name moved from m.From to m.To, or name unchanged if it is
+// not under m.From.
+func (m recordNameMapping) apply(name string) string {
+	trimmed, from := trimDot(name), trimDot(m.From)
+	if !inZone(trimmed, from) {
+		return name
+	}
+	return strings.TrimSuffix(trimmed, from) + trimDot(m.To) + "."
+}
+
+// duration is a time.Duration that is decoded from a Go duration string such
+// as "1.5s" in the solver config.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+const (
+	// defaultTTL is the challenge record TTL used when none is configured.
+	defaultTTL = 60
+	minTTL     = 30
+	maxTTL     = 86400
+
+	// defaultPropagationDelay is how long Present waits after publishing the
+	// zone when no delay is configured.
+	defaultPropagationDelay = 1300 * time.Millisecond
+
+	// defaultRequestTimeout bounds Dyn API requests when no timeout is
+	// configured.
+	defaultRequestTimeout = 30 * time.Second
+
+	// defaultSessionPath is the Dyn API path of sessions.
+	defaultSessionPath = "Session"
+)
+
+// propagationDelay returns how long to wait after publishing the zone.
+func (cfg *dynDNSProviderConfig) propagationDelay() time.Duration {
+	if cfg.PropagationDelay.Duration == 0 {
+		return defaultPropagationDelay
+	}
+	return cfg.PropagationDelay.Duration
+}
+
+// operationTimeout returns the timeout for a Dyn API operation with method to
+// endpoint, which is relative to the API base URL, covering the request and
+// polling the job Dyn may promote it to.
+func (cfg *dynDNSProviderConfig) operationTimeout(method, endpoint string) time.Duration {
+	var timeout time.Duration
+	switch record := strings.HasPrefix(endpoint, "TXTRecord/"); {
+	case record && (method == "POST" || method == "PUT"):
+		timeout = cfg.CreateTimeout.Duration
+	case record && method == "DELETE":
+		timeout = cfg.DeleteTimeout.Duration
+	case strings.HasPrefix(endpoint, "Zone/") && method == "PUT":
+		timeout = cfg.PublishTimeout.Duration
+	}
+	if timeout == 0 {
+		return cfg.requestTimeout()
+	}
+	return timeout
+}
+
+// requestTimeout returns the timeout for a single Dyn API request.
+func (cfg *dynDNSProviderConfig) requestTimeout() time.Duration {
+	if cfg.RequestTimeout.Duration == 0 {
+		return defaultRequestTimeout
+	}
+	return cfg.RequestTimeout.Duration
+}
+
+// sessionPath returns the API path at which Dyn sessions are managed.
+func (cfg *dynDNSProviderConfig) sessionPath() string {
+	if cfg.SessionPath == "" {
+		return defaultSessionPath
+	}
+	return cfg.SessionPath
+}
+
+// recordTTL returns the TTL to create the challenge record with: the TTL of
+// the configured zone containing ZoneName, falling back to TTL and then to
+// defaultTTL.
+func (cfg *dynDNSProviderConfig) recordTTL() int {
+	if zone := cfg.zoneConfig(); zone != nil && zone.TTL != 0 {
+		return zone.TTL
+	}
+	if cfg.TTL == 0 {
+		return defaultTTL
+	}
+	return cfg.TTL
+}
+
+// zoneConfig returns the most specific of the configured zones containing
+// ZoneName, or nil if there is none.
+func (cfg *dynDNSProviderConfig) zoneConfig() *dynZoneConfig {
+	var found *dynZoneConfig
+	zoneName := trimDot(cfg.ZoneName)
+	for i := range cfg.Zones {
+		name := trimDot(cfg.Zones[i].Name)
+		if inZone(zoneName, name) && (found == nil || len(name) > len(trimDot(found.Name))) {
+			found = &cfg.Zones[i]
+		}
+	}
+	return found
+}
+
+// autoCommit reports whether record changes are published by the webhook.
+func (cfg *dynDNSProviderConfig) autoCommit() bool {
+	return cfg.AutoCommit == nil || *cfg.AutoCommit
 }
 
 // Name is used as the name for this DNS solver when referencing it on the ACME
 // Issuer resource.
 func (c *dynDNSProviderSolver) Name() string {
-	return "dyndns"
+	if c.name == "" {
+		return defaultSolverName
+	}
+	return c.name
 }
 
 // Present is responsible for actually presenting the DNS record with the
 // DNS provider.
-func (c *dynDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
+func (c *dynDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) (err error) {
+	if err := checkChallenge(ch); err != nil {
+		err = solverError(err)
+		logError("Rejected challenge request", logFields{"operation": "present", "error": err})
+		presentTotal.WithLabelValues(outcome(err)).Inc()
+		return err
+	}
+	defer func() {
+		presentTotal.WithLabelValues(outcome(err)).Inc()
+		c.recordFailure(ch, "PresentFailed", err)
+	}()
+	defer func() { err = solverError(err) }()
+
 	cfg, err := loadConfig(ch.Config)
 	if err != nil {
 		return err
 	}
-	klog.V(4).Infof("creating a new dyndns record for: %s, fqdn: %s, value: %s\n", ch.DNSName, ch.ResolvedFQDN, ch.Key)
-	return c.createRecord(&cfg, ch)
+	cfg.requestID = challengeRequestID(ch)
+	cfg.namespace = ch.ResourceNamespace
+	return c.forEachTarget(&cfg, func(cfg dynDNSProviderConfig) error {
+		return c.present(cfg, ch)
+	})
+}
+
+// present creates the challenge record of ch in the Dyn account and zone of
+// cfg.
+func (c *dynDNSProviderSolver) present(cfg dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) (err error) {
+	ch = normalizeWildcard(ch)
+	ch = mapRecordNames(&cfg, ch)
+	if ch, err = c.followDelegation(&cfg, ch); err != nil {
+		return err
+	}
+	resolveZone(&cfg, ch)
+	logDebug("Presenting challenge", challengeFields(&cfg, ch, "present"))
+	if err := checkZone(&cfg, ch); err != nil {
+		return err
+	}
+
+	if err := c.loadCredentials(&cfg, ch.ResourceNamespace); err != nil {
+		return err
+	}
+
+	if cfg.SharedRecordCleanup && !cfg.DryRun {
+		c.retainSharedRecord(&cfg, ch)
+		defer func() {
+			if err != nil {
+				c.forgetSharedRecord(&cfg, ch)
+			}
+		}()
+	}
+
+	if err := c.beginSession(&cfg); err != nil {
+		return err
+	}
+	defer c.endSession(&cfg)
+
+	if cfg.DiscardPendingOnStart && !cfg.DryRun {
+		if err := c.discardPendingChanges(&cfg, ch.ResourceNamespace); err != nil {
+			return err
+		}
+	}
+
+	jobID, err := c.createRecord(&cfg, ch)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.DryRun {
+		link := buildRecordLink(cfg.ZoneName, ch.ResolvedFQDN)
+		if err := c.waitForPropagation(&cfg, ch, link); err != nil {
+			return err
+		}
+	}
+
+	fields := challengeFields(&cfg, ch, "present")
+	if jobID != 0 {
+		fields["job_id"] = jobID
+	}
+	logInfo("Presented challenge", fields)
+
+	return nil
 }
 
 func (c *dynDNSProviderSolver) validate(cfg *dynDNSProviderConfig) error {
+	// The credentials secret supplies the username, customerName and password
+	credentials := cfg.CredentialsSecretRef.Name != ""
+
 	// Check that the username is defined
-	if cfg.Username == "" {
-		return errors.New("No dyndns username provided")
+	if !credentials && cfg.Username == "" && cfg.UsernameSecretRef.LocalObjectReference.Name == "" && cfg.UsernameFile == "" {
+		return errors.New("No dyndns username, usernameSecretRef, usernameFile or credentialsSecretRef provided")
 	}
 
 	// Check that the customerName is defined
-	if cfg.CustomerName == "" {
-		return errors.New("No dyndns customerName provided")
+	if !credentials && cfg.CustomerName == "" {
+		return errors.New("No dyndns customerName or credentialsSecretRef provided")
+	}
+	// Catch customer names that cannot be right, such as an account email,
+	// which Dyn would only reject as wrong credentials
+	if cfg.CustomerName != "" {
+		if err := checkCustomerName(cfg.CustomerName); err != nil {
+			return err
+		}
+	}
+
+	// Check that the configured zones are named
+	for i, zone := range cfg.Zones {
+		if zone.Name == "" {
+			return fmt.Errorf("No name provided for dyndns zone %d", i)
+		}
+		if zone.TTL != 0 && (zone.TTL < minTTL || zone.TTL > maxTTL) {
+			return fmt.Errorf("dyndns ttl %d of zone %q is out of range, must be between %d and %d", zone.TTL, zone.Name, minTTL, maxTTL)
+		}
 	}
 
-	// Check that the zoneName is defined
+	// Check that the record name mappings are complete
+	for i, m := range cfg.RecordNameMappings {
+		if m.From == "" || m.To == "" {
+			return fmt.Errorf("dyndns recordNameMappings entry %d must have both from and to", i)
+		}
+	}
+
+	// Check that the zoneName is defined or could be derived
 	if cfg.ZoneName == "" {
-		return errors.New("No dyndns zoneName provided")
+		if len(cfg.Zones) > 0 {
+			return errors.New("None of the configured dyndns zones contains the challenge FQDN")
+		}
+		return errors.New("No dyndns zoneName provided and none could be derived from the resolved zone")
+	}
+
+	// Check that the TTL, if set, is within a sane range
+	if cfg.TTL != 0 && (cfg.TTL < minTTL || cfg.TTL > maxTTL) {
+		return fmt.Errorf("dyndns ttl %d is out of range, must be between %d and %d", cfg.TTL, minTTL, maxTTL)
+	}
+
+	// Check that the API endpoint, if set, is an absolute HTTP(S) URL
+	if cfg.APIEndpoint != "" {
+		u, err := url.Parse(cfg.APIEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("dyndns apiEndpoint %q is not a valid http(s) URL", cfg.APIEndpoint)
+		}
+	}
+
+	// Check that the proxy URL, if set, is an absolute HTTP(S) URL. It is not
+	// included in the error since it may hold credentials.
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("dyndns proxyURL is not a valid http(s) URL")
+		}
+	}
+
+	// Check that the dial network, if set, is a TCP network
+	switch cfg.DialNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("dyndns dialNetwork %q must be one of tcp, tcp4 or tcp6", cfg.DialNetwork)
+	}
+
+	// Check that the delays are not negative
+	if cfg.RetryBaseDelay.Duration < 0 {
+		return fmt.Errorf("dyndns retryBaseDelay %v must not be negative", cfg.RetryBaseDelay.Duration)
+	}
+	if cfg.PropagationDelay.Duration < 0 {
+		return fmt.Errorf("dyndns propagationDelay %v must not be negative", cfg.PropagationDelay.Duration)
+	}
+	if cfg.PropagationCheckInterval.Duration < 0 {
+		return fmt.Errorf("dyndns propagationCheckInterval %v must not be negative", cfg.PropagationCheckInterval.Duration)
+	}
+	if cfg.PropagationCheckRetries < 0 {
+		return fmt.Errorf("dyndns propagationCheckRetries %d must not be negative", cfg.PropagationCheckRetries)
+	}
+	if cfg.RequestTimeout.Duration < 0 {
+		return fmt.Errorf("dyndns requestTimeout %v must not be negative", cfg.RequestTimeout.Duration)
+	}
+	for name, timeout := range map[string]duration{
+		"createTimeout":  cfg.CreateTimeout,
+		"deleteTimeout":  cfg.DeleteTimeout,
+		"publishTimeout": cfg.PublishTimeout,
+	} {
+		if timeout.Duration < 0 {
+			return fmt.Errorf("dyndns %s %v must not be negative", name, timeout.Duration)
+		}
+	}
+	if cfg.ConfirmPublishTimeout.Duration < 0 {
+		return fmt.Errorf("dyndns confirmPublishTimeout %v must not be negative", cfg.ConfirmPublishTimeout.Duration)
+	}
+	if cfg.CommitDebounce.Duration < 0 {
+		return fmt.Errorf("dyndns commitDebounce %v must not be negative", cfg.CommitDebounce.Duration)
+	}
+
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("dyndns maxIdleConns %d and maxIdleConnsPerHost %d must not be negative", cfg.MaxIdleConns, cfg.MaxIdleConnsPerHost)
+	}
+	if cfg.IdleConnTimeout.Duration < 0 {
+		return fmt.Errorf("dyndns idleConnTimeout %v must not be negative", cfg.IdleConnTimeout.Duration)
+	}
+
+	if cfg.TargetQuorum < 0 || cfg.TargetQuorum > len(cfg.Targets) {
+		return fmt.Errorf("dyndns targetQuorum %d must be between 0 and the %d targets", cfg.TargetQuorum, len(cfg.Targets))
+	}
+
+	if cfg.MaxSessions < 0 {
+		return fmt.Errorf("dyndns maxSessions %d must not be negative", cfg.MaxSessions)
+	}
+	if cfg.SessionWaitTimeout.Duration < 0 {
+		return fmt.Errorf("dyndns sessionWaitTimeout %v must not be negative", cfg.SessionWaitTimeout.Duration)
+	}
+
+	if cfg.MaxRecordsPerName < 0 {
+		return fmt.Errorf("dyndns maxRecordsPerName %d must not be negative", cfg.MaxRecordsPerName)
+	}
+
+	// Check that the rate limit is not negative
+	if cfg.RequestsPerSecond < 0 {
+		return fmt.Errorf("dyndns requestsPerSecond %v must not be negative", cfg.RequestsPerSecond)
+	}
+
+	// Check that the circuit breaker settings are not negative
+	if cfg.CircuitBreakerThreshold < 0 {
+		return fmt.Errorf("dyndns circuitBreakerThreshold %d must not be negative", cfg.CircuitBreakerThreshold)
+	}
+	if cfg.CircuitBreakerCooldown.Duration < 0 {
+		return fmt.Errorf("dyndns circuitBreakerCooldown %v must not be negative", cfg.CircuitBreakerCooldown.Duration)
+	}
+
+	// Check that the commit notes template, if set, parses
+	if cfg.CommitNotesTemplate != "" {
+		if _, err := template.New("notes").Parse(cfg.CommitNotesTemplate); err != nil {
+			return fmt.Errorf("dyndns commitNotesTemplate is invalid: %v", err)
+		}
 	}
 
 	// Try to load the Password key
-	if cfg.PasswordSecretRef.LocalObjectReference.Name == "" {
+	if !credentials && cfg.PasswordSecretRef.LocalObjectReference.Name == "" && cfg.PasswordFile == "" {
 		return errors.New("No dydns password key provided")
 	}
 
 	return nil
 }
 
-func (c *dynDNSProviderSolver) dynClient(cfg *dynDNSProviderConfig, namespace string) (*dynect.Client, error) {
+func (c *dynDNSProviderSolver) dynClient(cfg *dynDNSProviderConfig, namespace string) (dynClientInterface, error) {
 	if err := c.validate(cfg); err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+
+	// The password is read before a cached session is handed out, so that
+	// only callers holding the password the session logged in with get it.
+	password, err := c.password(cfg, namespace)
+	if err != nil {
 		return nil, err
 	}
+	hash := sha256.Sum256([]byte(password))
+
+	// A pooled session is only used by the calling Present or CleanUp.
+	if s := cfg.session; s != nil {
+		if s.client != nil && s.passwordHash == hash && time.Now().Before(s.expires) {
+			s.expires = time.Now().Add(dynSessionTTL)
+			return s.client, nil
+		}
+		dynClient, err := c.loginWithPassword(cfg, password)
+		if err != nil {
+			return nil, err
+		}
+		if s.client != nil {
+			logout(s.client, s.path)
+		}
+		s.client, s.path, s.expires, s.passwordHash = dynClient, cfg.sessionPath(), time.Now().Add(dynSessionTTL), hash
+		return dynClient, nil
+	}
+
+	key := sessionKey(cfg)
+	for {
+		c.sessionsMu.Lock()
+		if s, ok := c.sessions[key]; ok && s.passwordHash == hash && time.Now().Before(s.expires) {
+			s.expires = time.Now().Add(dynSessionTTL)
+			c.sessionsMu.Unlock()
+			return s.client, nil
+		}
+
+		// Only one login per key is made at a time, without holding the
+		// lock, so that a slow login does not hold up other accounts.
+		if call, ok := c.logins[key]; ok {
+			c.sessionsMu.Unlock()
+			<-call.done
+			if call.err != nil {
+				return nil, call.err
+			}
+			// Look the session up again, since the login may have been
+			// made with another password.
+			continue
+		}
+		call := &loginCall{done: make(chan struct{})}
+		if c.logins == nil {
+			c.logins = make(map[string]*loginCall)
+		}
+		c.logins[key] = call
+		c.sessionsMu.Unlock()
+
+		dynClient, err := c.loginWithPassword(cfg, password)
 
-	sec, err := c.client.CoreV1().Secrets(namespace).Get(cfg.PasswordSecretRef.LocalObjectReference.Name, metav1.GetOptions{})
+		c.sessionsMu.Lock()
+		delete(c.logins, key)
+		if err == nil {
+			call.session = &dynSession{
+				client:       dynClient,
+				path:         cfg.sessionPath(),
+				expires:      time.Now().Add(dynSessionTTL),
+				passwordHash: hash,
+			}
+			if c.sessions == nil {
+				c.sessions = make(map[string]*dynSession)
+			}
+			c.sessions[key] = call.session
+		}
+		call.err = err
+		c.sessionsMu.Unlock()
+		close(call.done)
+
+		return dynClient, err
+	}
+}
+
+// login creates a new Dyn session for cfg, reading the password from the
+// given namespace, or from the password file if no secret is selected.
+func (c *dynDNSProviderSolver) login(cfg *dynDNSProviderConfig, namespace string) (dynClientInterface, error) {
+	password, err := c.password(cfg, namespace)
 	if err != nil {
 		return nil, err
 	}
+	return c.loginWithPassword(cfg, password)
+}
 
-	secBytes, ok := sec.Data[cfg.PasswordSecretRef.Key]
-	if !ok {
-		return nil, fmt.Errorf("Key %q not found in secret \"%s/%s\"", cfg.PasswordSecretRef.Key, cfg.PasswordSecretRef.LocalObjectReference.Name, namespace)
+// password returns the Dyn password of cfg, read from the given namespace,
+// or from the password file if no secret is selected.
+func (c *dynDNSProviderSolver) password(cfg *dynDNSProviderConfig, namespace string) (string, error) {
+	ref := cfg.PasswordSecretRef
+	if ref.LocalObjectReference.Name == "" && cfg.PasswordFile != "" {
+		password, err := c.readCredential(cfg, cfg.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		if password == "" {
+			return "", fmt.Errorf("password file %s is empty", cfg.PasswordFile)
+		}
+		return password, nil
 	}
 
-	password := string(secBytes)
+	password, err := c.secretValue(namespace, ref)
+	if err != nil {
+		return "", err
+	}
+	// Fail on an empty password here, since Dyn would only report it as wrong
+	// credentials.
+	if password == "" {
+		return "", fmt.Errorf("password value at key %q in secret \"%s/%s\" is empty", ref.Key, namespace, ref.LocalObjectReference.Name)
+	}
+	return password, nil
+}
 
-	dynClient := dynect.NewClient(cfg.CustomerName)
+// loginWithPassword creates a new Dyn session for cfg with the given password.
+func (c *dynDNSProviderSolver) loginWithPassword(cfg *dynDNSProviderConfig, password string) (dynClientInterface, error) {
+	dynClient, err := c.clientFactory()(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if limiter := c.rateLimiter(cfg); limiter != nil {
+		dynClient = rateLimitedClient{dynClient, limiter, cfg.requestTimeout()}
+	}
 
 	var resp dynect.LoginResponse
 	var req = dynect.LoginBlock{
@@ -133,93 +1070,697 @@ func (c *dynDNSProviderSolver) dynClient(cfg *dynDNSProviderConfig, namespace st
 		CustomerName: cfg.CustomerName,
 	}
 
-	errSession := dynClient.Do("POST", "Session", req, &resp)
+	// Session creation is retried on its own, since the record operations
+	// are only retried once logged in.
+	errSession := c.retryTransient(cfg.loginRetries(), cfg.retryBaseDelay(), "POST", cfg.sessionPath(), func() error {
+		return callDyn(dynClient, cfg.requestID, "POST", cfg.sessionPath(), req, &resp)
+	})
+	fields := cfg.logFields(logFields{"operation": "login"})
 	if errSession != nil {
-		klog.Errorf("Problem creating a session error: %s", errSession)
+		fields["error"] = errSession
+		logError("Error creating Dyn session", fields)
+		err := authenticationError(errSession)
+		if errors.Is(err, ErrAuthentication) {
+			err = fmt.Errorf("%w (check that customerName %q is the Dyn customer name rather than an account email or user name)", err, cfg.CustomerName)
+		}
 		return nil, err
-	} else {
-		klog.Infof("Successfully created Dyn session")
 	}
-	dynClient.Token = resp.Data.Token
+	logVerbose("Created Dyn session", fields)
+	dynClient.SetToken(resp.Data.Token)
 
 	return dynClient, nil
 }
 
-func (c *dynDNSProviderSolver) createRecord(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
-	link := fmt.Sprintf("%sRecord/%s/%s/", "TXT", ch.ResolvedZone, ch.ResolvedFQDN)
-	klog.V(4).Infof("the link is: %s", link)
+// secretValue returns the value of the secret key selected by ref in the
+// given namespace.
+func (c *dynDNSProviderSolver) secretValue(namespace string, ref cmmeta.SecretKeySelector) (string, error) {
+	var sec *corev1.Secret
+	var err error
+	if c.secrets != nil {
+		sec, err = c.secrets.get(namespace, ref.LocalObjectReference.Name)
+	} else {
+		sec, err = c.client.CoreV1().Secrets(namespace).Get(context.Background(), ref.LocalObjectReference.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return "", err
+	}
 
-	recordData := dynect.DataBlock{}
-	recordData.TxtData = ch.Key
-	record := dynect.RecordRequest{
-		TTL:   "60",
-		RData: recordData,
+	secBytes, ok := sec.Data[ref.Key]
+	if !ok {
+		return "", &SecretKeyNotFoundError{
+			Name:      ref.LocalObjectReference.Name,
+			Namespace: namespace,
+			Key:       ref.Key,
+		}
 	}
 
-	response := dynect.RecordResponse{}
-	dynClient, err := c.dynClient(cfg, ch.ResourceNamespace)
-	if err != nil {
-		klog.Errorf("Error creating dynClient: %v", err)
+	return string(secBytes), nil
+}
+
+// Keys of the secret selected by credentialsSecretRef.
+const (
+	credentialsUsernameKey     = "username"
+	credentialsCustomerNameKey = "customer-name"
+	credentialsPasswordKey     = "password"
+)
+
+// loadCredentials sets the username and customer name from the secrets or
+// files they are configured in, and points passwordSecretRef to the credentials secret
+// if one is configured. It also loads the TLS client certificate, if any.
+// This has to happen before the session for cfg is used, since sessions are
+// cached by username and customer name.
+func (c *dynDNSProviderSolver) loadCredentials(cfg *dynDNSProviderConfig, namespace string) error {
+	if err := c.loadClientTLS(cfg, namespace); err != nil {
 		return err
 	}
-	err = dynClient.Do("POST", link, record, &response)
-	klog.Infof("Creating record %s: %+v,", link, errorOrValue(err, &response))
+
+	if name := cfg.CredentialsSecretRef.Name; name != "" {
+		ref := func(key string) cmmeta.SecretKeySelector {
+			return cmmeta.SecretKeySelector{LocalObjectReference: cmmeta.LocalObjectReference{Name: name}, Key: key}
+		}
+
+		username, err := c.secretValue(namespace, ref(credentialsUsernameKey))
+		if err != nil {
+			return err
+		}
+		customerName, err := c.secretValue(namespace, ref(credentialsCustomerNameKey))
+		if err != nil {
+			return err
+		}
+
+		cfg.Username = username
+		cfg.CustomerName = customerName
+		cfg.PasswordSecretRef = ref(credentialsPasswordKey)
+		return nil
+	}
+
+	if cfg.UsernameSecretRef.LocalObjectReference.Name == "" {
+		if cfg.UsernameFile == "" {
+			return nil
+		}
+		username, err := c.readCredential(cfg, cfg.UsernameFile)
+		if err != nil {
+			return err
+		}
+		cfg.Username = username
+		return nil
+	}
+
+	username, err := c.secretValue(namespace, cfg.UsernameSecretRef)
 	if err != nil {
-		klog.Errorf("Error creating record: %v, %v", record, err)
 		return err
 	}
+	cfg.Username = username
 
-	commit(c, cfg, ch)
+	return nil
+}
 
-	klog.V(4).Info("sleeping for 1.3 seconds")
-	time.Sleep(1300 * time.Millisecond)
+// maxCustomerNameLength is the length beyond which a customer name is taken
+// to be a mistake.
+const maxCustomerNameLength = 64
 
+// checkCustomerName fails if name cannot be a Dyn customer name.
+func checkCustomerName(name string) error {
+	switch {
+	case strings.IndexFunc(name, unicode.IsSpace) >= 0:
+		return fmt.Errorf("dyndns customerName %q must not contain whitespace", name)
+	case strings.Contains(name, "@"):
+		return fmt.Errorf("dyndns customerName %q looks like an email address, but must be the Dyn customer name", name)
+	case len(name) > maxCustomerNameLength:
+		return fmt.Errorf("dyndns customerName is longer than %d characters", maxCustomerNameLength)
+	}
 	return nil
 }
 
-func errorOrValue(err error, value interface{}) interface{} {
-	if err == nil {
-		return value
+// readCredentialFile returns the contents of the credential file at path
+// without a trailing newline. The file is read on every call, so rotated
+// credentials are picked up without restarting the webhook.
+func readCredentialFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading credential file: %v", err)
 	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// readCredential returns the contents of the credential file cfg names at
+// path, which must be within the credentials directory of the solver unless
+// cfg comes from the deployment. Issuers could otherwise send any file of the
+// pod, such as its service account token, to an apiEndpoint of their choosing.
+func (c *dynDNSProviderSolver) readCredential(cfg *dynDNSProviderConfig, path string) (string, error) {
+	if cfg.trustedFiles {
+		return readCredentialFile(path)
+	}
+	if c.credentialsDir == "" {
+		return "", &ConfigError{Err: fmt.Errorf("dyndns credential file %s is not allowed, since no credentials directory is set with CREDENTIALS_DIR", path)}
+	}
+	if !filepath.IsAbs(path) {
+		return "", &ConfigError{Err: fmt.Errorf("dyndns credential file %s must be an absolute path", path)}
+	}
+
+	dir, err := filepath.EvalSymlinks(c.credentialsDir)
+	if err != nil {
+		return "", fmt.Errorf("error resolving the credentials directory: %v", err)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", fmt.Errorf("error reading credential file: %v", err)
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &ConfigError{Err: fmt.Errorf("dyndns credential file %s is not within the credentials directory %s", path, c.credentialsDir)}
+	}
+	return readCredentialFile(resolved)
+}
+
+// sessionKey returns the key under which the Dyn session for cfg is cached.
+// It covers the account, the namespace and secrets or files its credentials
+// are read from, and the settings of the transport the session is created
+// with, so that a session is only shared by configs that would create the
+// same one.
+func sessionKey(cfg *dynDNSProviderConfig) string {
+	identity, _ := json.Marshal([]interface{}{
+		cfg.APIEndpoint, cfg.SessionPath, cfg.CustomerName, cfg.Username,
+		cfg.namespace, cfg.UsernameSecretRef, cfg.UsernameFile,
+		cfg.PasswordSecretRef, cfg.PasswordFile, cfg.CredentialsSecretRef,
+		cfg.ClientCertSecretRef, cfg.ProxyURL, cfg.DialNetwork, cfg.Headers,
+		cfg.MaxIdleConns, cfg.MaxIdleConnsPerHost, cfg.IdleConnTimeout,
+		cfg.RequestTimeout, cfg.CreateTimeout, cfg.DeleteTimeout, cfg.PublishTimeout,
+		cfg.MaxRetries, cfg.RequestsPerSecond,
+		cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown,
+	})
+	return string(identity)
+}
+
+// evictSession drops the cached Dyn session for cfg, if any.
+func (c *dynDNSProviderSolver) evictSession(cfg *dynDNSProviderConfig) {
+	if cfg.session != nil {
+		cfg.session.client = nil
+		return
+	}
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	delete(c.sessions, sessionKey(cfg))
+}
+
+// beginSession marks the Dyn session for cfg as in use by the calling
+// Present or CleanUp, or hands it a pooled session if MaxSessions is set.
+// Once any config of an account sets MaxSessions, the configs of the account
+// that do not set it are handed pooled sessions too, so that their sessions
+// count towards the limit. Every successful call must be paired with a call
+// to endSession.
+func (c *dynDNSProviderSolver) beginSession(cfg *dynDNSProviderConfig) error {
+	if cfg.MaxSessions > 0 || c.pool(cfg) != nil {
+		return c.acquireSession(cfg)
+	}
+
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	if c.sessionUsers == nil {
+		c.sessionUsers = make(map[string]int)
+	}
+	c.sessionUsers[sessionKey(cfg)]++
+	return nil
+}
+
+// endSession releases the Dyn session for cfg. When no other Present or
+// CleanUp is using it, the session is evicted and destroyed on the Dyn side
+// so that abandoned sessions do not accumulate until they time out.
+func (c *dynDNSProviderSolver) endSession(cfg *dynDNSProviderConfig) {
+	if cfg.session != nil {
+		c.releaseSession(cfg)
+		return
+	}
+	key := sessionKey(cfg)
+
+	c.sessionsMu.Lock()
+	c.sessionUsers[key]--
+	if c.sessionUsers[key] > 0 {
+		c.sessionsMu.Unlock()
+		return
+	}
+	delete(c.sessionUsers, key)
+	s, ok := c.sessions[key]
+	delete(c.sessions, key)
+	c.sessionsMu.Unlock()
+
+	if ok {
+		logout(s.client, s.path)
+	}
+}
+
+// closeSessions evicts and destroys all cached Dyn sessions, so that they are
+// not abandoned on the Dyn side when the webhook shuts down.
+func (c *dynDNSProviderSolver) closeSessions() {
+	c.sessionsMu.Lock()
+	var sessions []*dynSession
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.sessions = nil
+	for _, pool := range c.pools {
+		sessions = append(sessions, pool.drain()...)
+	}
+	c.sessionsMu.Unlock()
+
+	for _, s := range sessions {
+		logout(s.client, s.path)
+	}
+}
+
+// logout destroys the Dyn session held by dynClient at the session path.
+// Failures are logged and returned, but the solver ignores them, since the
+// record change the session was used for already succeeded.
+func logout(dynClient dynClientInterface, path string) error {
+	var resp dynect.ResponseBlock
+	if err := callDyn(dynClient, "", "DELETE", path, nil, &resp); err != nil {
+		klog.Warningf("Error destroying Dyn session: %v", err)
+		return err
+	}
+	klog.V(4).Info("Destroyed Dyn session")
+	return nil
+}
+
+// doRequest issues a Dyn API request using the cached session for cfg. If Dyn
+// rejects the session token, the cached session is evicted and the request is
+// retried once after logging in again.
+func (c *dynDNSProviderSolver) doRequest(cfg *dynDNSProviderConfig, namespace, method, endpoint string, requestData, responseData interface{}) error {
+	dynClient, err := c.dynClient(cfg, namespace)
+	if err != nil {
+		klog.Errorf("Error creating dynClient: %v", err)
+		return err
+	}
+
+	err = c.withRetries(cfg, method, endpoint, func() error {
+		return callDyn(dynClient, cfg.requestID, method, endpoint, requestData, responseData)
+	})
+	if !isSessionInvalid(err) {
+		return authorizationError(err)
+	}
+
+	klog.Infof("Dyn session rejected, logging in again: %v", err)
+	c.evictSession(cfg)
+	dynClient, err = c.dynClient(cfg, namespace)
+	if err != nil {
+		klog.Errorf("Error creating dynClient: %v", err)
+		return err
+	}
+
+	err = c.withRetries(cfg, method, endpoint, func() error {
+		return callDyn(dynClient, cfg.requestID, method, endpoint, requestData, responseData)
+	})
+	return authorizationError(err)
+}
+
+// callDyn issues a single Dyn API request, recording its duration and outcome
+// in the API metrics and logging it, so that slow challenges can be
+// correlated with Dyn API latency. The timing is logged at -v=2 with the
+// other routine steps of a challenge rather than at info level, so that mass
+// renewals do not flood the logs at the default verbosity; the duration
+// histogram is recorded at any verbosity. requestID identifies the challenge
+// the request is made for, if any.
+func callDyn(dynClient dynClientInterface, requestID, method, endpoint string, requestData, responseData interface{}) error {
+	start := time.Now()
+	err := dynClient.Do(method, endpoint, requestData, responseData)
+	observeAPICall(method, endpoint, start, err)
+
+	fields := logFields{
+		"operation": apiOperation(method, endpoint),
+		"endpoint":  endpoint,
+		"duration":  time.Since(start),
+	}
+	if requestID != "" {
+		fields["request_id"] = requestID
+	}
+	if err != nil {
+		fields["error"] = err
+	}
+	logVerbose("Dyn API call", fields)
 
 	return err
 }
 
+// createRecord creates and publishes the challenge TXT record unless it
+// exists already. It does not wait for the record to propagate. It returns
+// the ID of the Dyn job that created the record, or 0 if no record was
+// created, for correlation with the Dyn change log.
+//
+// The record is created with a POST, which adds it next to any other TXT
+// records at the name, so that the challenges for several keys mapping to
+// the same name can be presented at once. A PUT would replace them.
+func (c *dynDNSProviderSolver) createRecord(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) (int, error) {
+	link := buildRecordLink(cfg.ZoneName, ch.ResolvedFQDN)
+	fields := challengeFields(cfg, ch, "present")
+	if err := c.checkZoneAllowed(cfg); err != nil {
+		fields["error"] = err
+		logError("Error creating record", fields)
+		return 0, err
+	}
+
+	existing, err := c.findTXTRecord(cfg, ch.ResourceNamespace, link, ch.Key)
+	if err != nil {
+		fields["error"] = err
+		logError("Error looking up records", fields)
+		return 0, err
+	}
+	if existing != "" {
+		logVerbose("Record already matches the challenge key, skipping creation", fields)
+		// The record may have been created by an earlier Present whose
+		// publish failed, so the zone is published if that left changes
+		// pending. Otherwise there is nothing to publish.
+		if cfg.DryRun || !cfg.autoCommit() {
+			return 0, nil
+		}
+		pending, err := c.hasPendingChanges(cfg, ch.ResourceNamespace)
+		if err != nil {
+			fields["error"] = err
+			logError("Error looking up pending changes", fields)
+			return 0, err
+		}
+		if !pending {
+			return 0, nil
+		}
+		if err := c.commitChanges(cfg, ch); err != nil {
+			return 0, &CommitFailedAfterCreateError{
+				Zone:   trimDot(cfg.ZoneName),
+				Record: existing,
+				Err:    err,
+			}
+		}
+		return 0, nil
+	}
+
+	recordData := dynect.DataBlock{}
+	recordData.TxtData = txtValue(ch.Key)
+	record := dynect.RecordRequest{
+		TTL:   strconv.Itoa(cfg.recordTTL()),
+		RData: recordData,
+	}
+
+	if cfg.DryRun {
+		fields["ttl"] = record.TTL
+		logInfo("Dry run, not creating record and publishing zone", fields)
+		return 0, nil
+	}
+
+	// A record is created at link, unless the only record there is updated
+	// in place.
+	method, target := "POST", link
+	if cfg.UpdateInPlace {
+		stale, err := c.onlyTXTRecord(cfg, ch.ResourceNamespace, link)
+		if err != nil {
+			fields["error"] = err
+			logError("Error looking up records", fields)
+			return 0, err
+		}
+		if stale != "" {
+			method, target = "PUT", stale
+			fields["record"] = stale
+		}
+	}
+
+	start := time.Now()
+	response := dynect.RecordResponse{}
+	err = c.doRequest(cfg, ch.ResourceNamespace, method, target, record, &response)
+	// Dyn rejects TTLs below the zone minimum, which it names in the error,
+	// so the record is created once more with that minimum.
+	if ttl, ok := minimumTTL(err); ok && strconv.Itoa(ttl) != record.TTL {
+		fields["ttl"] = ttl
+		logInfo("Raising the record TTL to the zone minimum", fields)
+		record.TTL = strconv.Itoa(ttl)
+		err = c.doRequest(cfg, ch.ResourceNamespace, method, target, record, &response)
+	}
+	fields["duration"] = time.Since(start)
+	if err != nil {
+		withDynMessages(fields, err)
+		logError("Error creating record", fields)
+		return 0, err
+	}
+	jobID := response.JobId
+	if jobID != 0 {
+		fields["job_id"] = jobID
+	}
+	if method == "PUT" {
+		logVerbose("Updated record", fields)
+	} else {
+		logVerbose("Created record", fields)
+	}
+
+	if cfg.VerifyBeforeCommit {
+		created, err := c.findTXTRecord(cfg, ch.ResourceNamespace, link, ch.Key)
+		if err == nil && created == "" {
+			err = fmt.Errorf("dyndns TXT record %s was created but does not hold the challenge key", link)
+		}
+		if err != nil {
+			delete(fields, "duration")
+			fields["error"] = err
+			logError("Error verifying record", fields)
+			return jobID, err
+		}
+	}
+
+	if !cfg.autoCommit() {
+		logVerbose("Auto commit disabled, leaving the zone unpublished", fields)
+		return jobID, nil
+	}
+	if err := c.commitChanges(cfg, ch); err != nil {
+		return jobID, &CommitFailedAfterCreateError{
+			Zone:   trimDot(cfg.ZoneName),
+			Record: target,
+			JobID:  jobID,
+			Err:    err,
+		}
+	}
+
+	return jobID, nil
+}
+
+// challengeFields returns the log fields identifying ch and the operation
+// performed for it.
+func challengeFields(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest, operation string) logFields {
+	fields := cfg.logFields(logFields{
+		"zone":      cfg.ZoneName,
+		"fqdn":      ch.ResolvedFQDN,
+		"key":       ch.Key,
+		"operation": operation,
+	})
+	if cfg.APIEndpoint != "" {
+		fields["api_endpoint"] = cfg.APIEndpoint
+	}
+	return fields
+}
+
 // CleanUp should delete the relevant TXT record from the DNS provider console.
 // If multiple TXT records exist with the same record name (e.g.
 // _acme-challenge.example.com) then **only** the record with the same `key`
 // value provided on the ChallengeRequest should be cleaned up.
 // This is in order to facilitate multiple DNS validations for the same domain
 // concurrently.
-func (c *dynDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
-	klog.Infof("deleting a dyndns record for domain: %s\n", ch.ResolvedFQDN)
+func (c *dynDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) (err error) {
+	if err := checkChallenge(ch); err != nil {
+		err = solverError(err)
+		logError("Rejected challenge request", logFields{"operation": "cleanup", "error": err})
+		cleanupTotal.WithLabelValues(outcome(err)).Inc()
+		return err
+	}
+	defer func() {
+		cleanupTotal.WithLabelValues(outcome(err)).Inc()
+		c.recordFailure(ch, "CleanUpFailed", err)
+	}()
+	defer func() { err = solverError(err) }()
 
 	cfg, err := loadConfig(ch.Config)
 	if err != nil {
 		return err
 	}
+	cfg.requestID = challengeRequestID(ch)
+	cfg.namespace = ch.ResourceNamespace
+	if cfg.SkipCleanup {
+		logInfo("Leaving the record in place since skipCleanup is set", challengeFields(&cfg, ch, "cleanup"))
+		return nil
+	}
+	return c.forEachTarget(&cfg, func(cfg dynDNSProviderConfig) error {
+		return c.cleanUp(cfg, ch)
+	})
+}
 
-	link := fmt.Sprintf("%sRecord/%s/%s/", "TXT", ch.ResolvedZone, ch.ResolvedFQDN)
-	klog.Infof("deleting record: %s", link)
-	response := dynect.RecordResponse{}
-	dynClient, err := c.dynClient(&cfg, ch.ResourceNamespace)
-	if err != nil {
-		klog.Errorf("Error creating dynClient: %v", err)
+// cleanUp deletes the challenge record of ch from the Dyn account and zone of
+// cfg.
+func (c *dynDNSProviderSolver) cleanUp(cfg dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) (err error) {
+	ch = normalizeWildcard(ch)
+	ch = mapRecordNames(&cfg, ch)
+	if ch, err = c.followDelegation(&cfg, ch); err != nil {
+		return err
+	}
+	resolveZone(&cfg, ch)
+	fields := challengeFields(&cfg, ch, "cleanup")
+	logVerbose("Cleaning up challenge", fields)
+	if err := checkZone(&cfg, ch); err != nil {
 		return err
 	}
-	err = dynClient.Do("DELETE", link, nil, &response)
-	klog.Infof("Deleting record %s: %+v\n", link, errorOrValue(err, &response))
+
+	if err := c.loadCredentials(&cfg, ch.ResourceNamespace); err != nil {
+		return err
+	}
+
+	if err := c.beginSession(&cfg); err != nil {
+		return err
+	}
+	defer c.endSession(&cfg)
+
+	if err := c.checkZoneAllowed(&cfg); err != nil {
+		fields["error"] = err
+		logError("Error deleting record", fields)
+		return err
+	}
+	link := buildRecordLink(cfg.ZoneName, ch.ResolvedFQDN)
+	if err := c.checkRecordCount(&cfg, ch.ResourceNamespace, link); err != nil {
+		fields["error"] = err
+		logError("Error checking records", fields)
+		return err
+	}
+
+	recordLink, err := c.findTXTRecord(&cfg, ch.ResourceNamespace, link, ch.Key)
 	if err != nil {
-		klog.Errorf("Error deleting domain name: %s, %v", link, err)
+		fields["error"] = err
+		logError("Error looking up records", fields)
 		return err
 	}
+	if recordLink != "" {
+		// The record exists, so failing to delete it or to publish its
+		// removal leaves it behind.
+		defer func() {
+			if err != nil {
+				recordOrphan(&cfg, ch, err)
+			}
+		}()
+	}
+	if recordLink == "" && (!cfg.SharedRecordCleanup || cfg.DryRun) {
+		logVerbose("No record matches the challenge key, nothing to clean up", fields)
+		return nil
+	}
 
-	commit(c, &cfg, ch)
+	if cfg.DryRun {
+		logInfo("Dry run, not deleting record and publishing zone", fields)
+		return nil
+	}
+
+	if recordLink != "" {
+		start := time.Now()
+		response := dynect.RecordResponse{}
+		err = c.doRequest(&cfg, ch.ResourceNamespace, "DELETE", recordLink, nil, &response)
+		fields["duration"] = time.Since(start)
+		if err != nil {
+			withDynMessages(fields, err)
+			logError("Error deleting record", fields)
+			return err
+		}
+		logVerbose("Deleted record", fields)
+		delete(fields, "duration")
+	} else {
+		logVerbose("No record matches the challenge key", fields)
+	}
+
+	if cfg.SharedRecordCleanup {
+		publish, err := c.releaseSharedRecord(&cfg, ch, recordLink != "", fields)
+		if err != nil {
+			withDynMessages(fields, err)
+			logError("Error deleting deferred records", fields)
+			return err
+		}
+		if !publish {
+			logInfo("Cleaned up challenge", fields)
+			return nil
+		}
+	}
+
+	if !cfg.autoCommit() {
+		logVerbose("Auto commit disabled, leaving the zone unpublished", fields)
+	} else if err := c.commitChanges(&cfg, ch); err != nil {
+		return err
+	}
+	logInfo("Cleaned up challenge", fields)
 
 	return nil
 }
 
-// Initialize will be called when the webhook first starts.
+// recordOrphan counts and logs the challenge record of ch that a failed
+// cleanUp may have left behind.
+func recordOrphan(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest, err error) {
+	orphanedRecordsTotal.Inc()
+	fields := challengeFields(cfg, ch, "cleanup")
+	fields["error"] = err
+	logError("Challenge record may have been left behind", fields)
+}
+
+// findTXTRecord returns the link of the TXT record under link whose value is
+// key, or an empty string if no such record exists.
+func (c *dynDNSProviderSolver) findTXTRecord(cfg *dynDNSProviderConfig, namespace, link, key string) (string, error) {
+	records := dynect.AllRecordsResponse{}
+	err := c.doRequest(cfg, namespace, "GET", link, nil, &records)
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, uri := range records.Data {
+		recordLink := strings.TrimPrefix(uri, "/REST/")
+		record := dynect.RecordResponse{}
+		if err := c.doRequest(cfg, namespace, "GET", recordLink, nil, &record); err != nil {
+			return "", err
+		}
+		if txtValue(record.Data.RData.TxtData) == txtValue(key) {
+			klog.V(4).Infof("found record %d at %s matching the challenge key", record.Data.RecordId, recordLink)
+			return recordLink, nil
+		}
+	}
+
+	return "", nil
+}
+
+// onlyTXTRecord returns the link of the TXT record at link if it is the only
+// one there, or an empty string otherwise.
+func (c *dynDNSProviderSolver) onlyTXTRecord(cfg *dynDNSProviderConfig, namespace, link string) (string, error) {
+	records := dynect.AllRecordsResponse{}
+	err := c.doRequest(cfg, namespace, "GET", link, nil, &records)
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(records.Data) != 1 {
+		return "", nil
+	}
+	return strings.TrimPrefix(records.Data[0], "/REST/"), nil
+}
+
+// checkRecordCount fails if more TXT records exist at link than allowed by
+// cfg.MaxRecordsPerName. It does not make any request when no limit is set.
+func (c *dynDNSProviderSolver) checkRecordCount(cfg *dynDNSProviderConfig, namespace, link string) error {
+	if cfg.MaxRecordsPerName == 0 {
+		return nil
+	}
+
+	records := dynect.AllRecordsResponse{}
+	err := c.doRequest(cfg, namespace, "GET", link, nil, &records)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n := len(records.Data); n > cfg.MaxRecordsPerName {
+		return fmt.Errorf("dyndns refusing to clean up %s: %d TXT records exceed maxRecordsPerName %d", link, n, cfg.MaxRecordsPerName)
+	}
+	return nil
+}
+
+// Initialize will be called when the webhook first starts. The cached Dyn
+// sessions are destroyed, and event recording is stopped once stopCh is
+// closed.
 func (c *dynDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
 
 	cl, err := kubernetes.NewForConfig(kubeClientConfig)
@@ -228,68 +1769,388 @@ func (c *dynDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh
 	}
 
 	c.client = cl
+	c.stopCh = stopCh
+	c.secrets = newSecretCache(cl)
+	recorder, broadcaster := newEventRecorder(cl)
+	c.recorder = recorder
+
+	go func() {
+		<-stopCh
+		c.closeSessions()
+		broadcaster.Shutdown()
+	}()
+
+	if c.canary != nil {
+		c.startSelfTest(c.canary)
+	}
+	return nil
+}
+
+// resolveZone picks the Dyn zone the challenge record is created in and
+// published. Unless the config names the zone explicitly, the most specific
+// configured zone containing the challenge FQDN is used, or the zone
+// cert-manager resolved for the challenge if no zones are configured, or
+// DEFAULT_ZONE_NAME if cert-manager resolved none. When
+// cert-manager resolved a subzone of that zone, such as a delegated
+// _acme-challenge zone, the subzone is used instead.
+func resolveZone(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) {
+	resolved := trimDot(ch.ResolvedZone)
+	if cfg.ZoneName == "" && len(cfg.Zones) == 0 {
+		cfg.ZoneName = resolved
+		// DEFAULT_ZONE_NAME only applies when there is no zone to select.
+		if cfg.ZoneName == "" {
+			cfg.ZoneName = trimDot(os.Getenv("DEFAULT_ZONE_NAME"))
+		}
+	}
+
+	if cfg.ZoneName == "" {
+		fqdn := trimDot(ch.ResolvedFQDN)
+		for _, zone := range cfg.Zones {
+			name := trimDot(zone.Name)
+			if inZone(fqdn, name) && len(name) > len(cfg.ZoneName) {
+				cfg.ZoneName = name
+			}
+		}
+	}
+
+	if zone := trimDot(cfg.ZoneName); zone != "" && resolved != zone && inZone(resolved, zone) {
+		cfg.ZoneName = resolved
+	}
+}
+
+// normalizeWildcard returns ch with any "*" label dropped from its resolved
+// FQDN. The challenge of a wildcard name such as *.example.com is validated
+// at _acme-challenge.example.com, which is what cert-manager resolves it to,
+// but a "*" left in the name would otherwise end up in the Dyn record link.
+// ch is never modified.
+func normalizeWildcard(ch *v1alpha1.ChallengeRequest) *v1alpha1.ChallengeRequest {
+	labels := strings.Split(ch.ResolvedFQDN, ".")
+	kept := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label != "*" {
+			kept = append(kept, label)
+		}
+	}
+	if len(kept) == len(labels) {
+		return ch
+	}
+
+	normalized := *ch
+	normalized.ResolvedFQDN = strings.Join(kept, ".")
+	return &normalized
+}
+
+// mapRecordNames returns ch with its resolved FQDN rewritten by the record
+// name mapping of cfg with the longest From matching it. ch is returned as is
+// when no mapping matches, and is never modified.
+func mapRecordNames(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) *v1alpha1.ChallengeRequest {
+	fqdn := trimDot(ch.ResolvedFQDN)
+	var match *recordNameMapping
+	for i, m := range cfg.RecordNameMappings {
+		from := trimDot(m.From)
+		if from != "" && inZone(fqdn, from) && (match == nil || len(from) > len(trimDot(match.From))) {
+			match = &cfg.RecordNameMappings[i]
+		}
+	}
+	if match == nil {
+		return ch
+	}
+
+	mapped := *ch
+	mapped.ResolvedFQDN = match.apply(ch.ResolvedFQDN)
+	return &mapped
+}
+
+// txtValue returns value quoted as Dyn expects TXT record data, leaving values
+// that are already quoted as they are.
+func txtValue(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value
+	}
+	return `"` + value + `"`
+}
+
+// inZone reports whether the domain name fqdn is within zone. Both names must
+// be given without a trailing dot.
+func inZone(fqdn, zone string) bool {
+	return fqdn == zone || strings.HasSuffix(fqdn, "."+zone)
+}
+
+// checkChallenge returns an error if ch lacks a field every challenge needs,
+// so that requests cert-manager sends without them fail cleanly instead of
+// producing malformed Dyn API links. The zone is checked by checkZone, since
+// an empty ResolvedZone is fine when the zone is configured.
+func checkChallenge(ch *v1alpha1.ChallengeRequest) error {
+	switch {
+	case ch == nil:
+		return &ConfigError{Err: errors.New("dyndns received an empty challenge request")}
+	case ch.Config == nil:
+		return &ConfigError{Err: fmt.Errorf("dyndns challenge request for %q has no solver config", ch.ResolvedFQDN)}
+	case strings.Trim(ch.ResolvedFQDN, ".") == "":
+		return &ConfigError{Err: fmt.Errorf("dyndns challenge request for %q in namespace %q has no ResolvedFQDN", ch.DNSName, ch.ResourceNamespace)}
+	case ch.Key == "":
+		return &ConfigError{Err: fmt.Errorf("dyndns challenge request for %q has no key", ch.ResolvedFQDN)}
+	}
+	return nil
+}
+
+// checkZone returns an error if there is no zone to solve the challenge in,
+// or if the challenge FQDN is not within the zone cfg publishes, which Dyn
+// would otherwise report as an unhelpful 404.
+func checkZone(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+	fqdn, zone := trimDot(ch.ResolvedFQDN), trimDot(cfg.ZoneName)
+	if zone == "" {
+		return &ConfigError{Err: fmt.Errorf("no zone to solve the challenge for %q in: the challenge has an empty ResolvedZone and no dyndns zonename is configured", fqdn)}
+	}
+	if !inZone(fqdn, zone) {
+		return &ConfigError{Err: fmt.Errorf("fqdn %q is not within zone %q", fqdn, zone)}
+	}
+	return nil
+}
 
+// checkZoneAllowed returns an error if the zone of cfg is not in the zone
+// allowlist of the solver or of cfg, when they are set.
+func (c *dynDNSProviderSolver) checkZoneAllowed(cfg *dynDNSProviderConfig) error {
+	zone := trimDot(cfg.ZoneName)
+	for _, allowlist := range [][]string{c.zoneAllowlist, cfg.ZoneAllowlist} {
+		if len(allowlist) > 0 && !containsZone(allowlist, zone) {
+			return &ConfigError{Err: fmt.Errorf("dyndns zone %q is not in the zone allowlist, refusing to change it", zone)}
+		}
+	}
 	return nil
 }
 
+// containsZone reports whether zones holds zone.
+func containsZone(zones []string, zone string) bool {
+	for _, z := range zones {
+		if strings.EqualFold(trimDot(z), zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// buildRecordLink returns the Dyn API link of the TXT records of fqdn in
+// zone. Trailing dots are stripped from both names.
+func buildRecordLink(zone, fqdn string) string {
+	return fmt.Sprintf("TXTRecord/%s/%s/", trimDot(zone), trimDot(fqdn))
+}
+
+// buildZoneLink returns the Dyn API link of zone, stripping its trailing dot.
+func buildZoneLink(zone string) string {
+	return fmt.Sprintf("Zone/%s/", trimDot(zone))
+}
+
+// trimDot strips the trailing dot of a fully qualified domain name, which the
+// Dyn API does not accept in its links.
+func trimDot(name string) string {
+	return strings.TrimSuffix(name, ".")
+}
+
 // loadConfig is a small helper function that decodes JSON configuration into
 // the typed config struct.
 func loadConfig(cfgJSON *extapi.JSON) (dynDNSProviderConfig, error) {
 	cfg := dynDNSProviderConfig{}
 	// handle the 'base case' where no configuration has been provided
 	if cfgJSON == nil {
+		applyEnvDefaults(&cfg)
 		return cfg, nil
 	}
-	if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
-		return cfg, fmt.Errorf("error decoding solver config: %v", err)
+	// Reject unknown fields, so that a misspelt field fails here rather than
+	// being ignored.
+	dec := json.NewDecoder(bytes.NewReader(cfgJSON.Raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, &ConfigError{Err: fmt.Errorf("error decoding solver config: %v", err)}
 	}
+	applyEnvDefaults(&cfg)
 
 	return cfg, nil
 }
 
-// commit commits all pending changes. It will always attempt to commit, if there are no
-func commit(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
-	klog.Infof("Committing changes")
-	// extra call if in debug mode to fetch pending changes
-	hostName, err := os.Hostname()
-	if err != nil {
-		hostName = "unknown-host"
+// applyEnvDefaults fills the username and customer name left empty in cfg
+// from DEFAULT_USERNAME and DEFAULT_CUSTOMER_NAME, so that issuers sharing
+// them need not repeat them. DEFAULT_ZONE_NAME is applied by resolveZone,
+// since it must not take precedence over the zones of the challenge.
+func applyEnvDefaults(cfg *dynDNSProviderConfig) {
+	for _, d := range []struct {
+		field *string
+		env   string
+	}{
+		{&cfg.Username, "DEFAULT_USERNAME"},
+		{&cfg.CustomerName, "DEFAULT_CUSTOMER_NAME"},
+	} {
+		if *d.field == "" {
+			*d.field = os.Getenv(d.env)
+		}
 	}
-	notes := fmt.Sprintf("Change by external-dns@%s, DynAPI@%s, %s on %s",
-		"external-dns-client",
-		"external-dns-client-version",
-		time.Now().Format(time.RFC3339),
-		hostName,
-	)
+}
 
-	zonePublish := ZonePublishRequest{
-		Publish: true,
-		Notes:   notes,
+// zoneLock returns the mutex serialising publishes of zone. Zone names are
+// compared without their trailing dot and case, as DNS does.
+func (c *dynDNSProviderSolver) zoneLock(zone string) *sync.Mutex {
+	lock, _ := c.zoneLocks.LoadOrStore(strings.ToLower(trimDot(zone)), &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// hasPendingChanges reports whether changes to the zone have been staged in
+// the Dyn session but not published.
+func (c *dynDNSProviderSolver) hasPendingChanges(cfg *dynDNSProviderConfig, namespace string) (bool, error) {
+	link := fmt.Sprintf("ZoneChanges/%s/", trimDot(cfg.ZoneName))
+	var response struct {
+		dynect.ResponseBlock
+		Data []json.RawMessage `json:"data"`
+	}
+	err := c.doRequest(cfg, namespace, "GET", link, nil, &response)
+	if err == nil {
+		err = checkStatus(response.ResponseBlock)
 	}
+	if err != nil {
+		return false, err
+	}
+	return len(response.Data) > 0, nil
+}
 
-	response := ZonePublishResponse{}
+// discardPendingChanges drops all changes to the zone that have been staged
+// in the Dyn session but not published.
+func (c *dynDNSProviderSolver) discardPendingChanges(cfg *dynDNSProviderConfig, namespace string) error {
+	fields := cfg.logFields(logFields{"zone": cfg.ZoneName, "operation": "discard"})
+	link := fmt.Sprintf("ZoneChanges/%s/", trimDot(cfg.ZoneName))
+	if err := c.checkZoneAllowed(cfg); err != nil {
+		fields["error"] = err
+		logError("Error discarding pending changes", fields)
+		return err
+	}
 
-	klog.Infof("Committing changes for zone %s: %+v", cfg.ZoneName, errorOrValue(err, &response))
+	lock := c.zoneLock(cfg.ZoneName)
+	lock.Lock()
+	defer lock.Unlock()
 
-	link := fmt.Sprintf("Zone/%s/", cfg.ZoneName)
-	dynClient, err := c.dynClient(cfg, ch.ResourceNamespace)
+	response := dynect.ResponseBlock{}
+	err := c.doRequest(cfg, namespace, "DELETE", link, nil, &response)
+	if err == nil {
+		err = checkStatus(response)
+	}
 	if err != nil {
-		klog.Errorf("Error creating dynClient: %v", err)
+		fields["error"] = err
+		logError("Error discarding pending changes", fields)
 		return err
 	}
-	err = dynClient.Do("PUT", link, &zonePublish, &response)
-	klog.Infof("Creating record %s: %+v,", link, errorOrValue(err, &response))
+	logVerbose("Discarded pending changes", fields)
+
+	return nil
+}
+
+// commit publishes all pending changes of the zone, which were staged for chs.
+// It fails if Dyn reports anything but success for the publish, in which case
+// the changes are left pending.
+func commit(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig, chs ...*v1alpha1.ChallengeRequest) (err error) {
+	defer func() {
+		commitTotal.WithLabelValues(outcome(err)).Inc()
+	}()
+
+	ch := chs[0]
+	fqdns := make([]string, len(chs))
+	for i, ch := range chs {
+		fqdns[i] = ch.ResolvedFQDN
+	}
+	fields := cfg.logFields(logFields{"zone": cfg.ZoneName, "fqdn": joinDistinct(fqdns), "operation": "commit"})
+	if err := c.checkZoneAllowed(cfg); err != nil {
+		fields["error"] = err
+		logError("Error committing changes to zone", fields)
+		return err
+	}
+	notes, err := commitNotes(cfg, chs...)
 	if err != nil {
-		klog.Errorf("Error creating record: %v, %v", zonePublish, err)
+		fields["error"] = err
+		logError("Error rendering commit notes", fields)
 		return err
 	}
 
+	zonePublish := ZonePublishRequest{
+		Publish: true,
+		Notes:   notes,
+	}
+
+	var serial int
+	if cfg.ConfirmPublish {
+		if serial, err = c.zoneSerial(cfg, ch.ResourceNamespace); err != nil {
+			fields["error"] = err
+			logError("Error reading zone serial", fields)
+			return err
+		}
+	}
+
+	var response ZonePublishResponse
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		response, err = c.publish(cfg, ch.ResourceNamespace, &zonePublish)
+		if !isOperationInProgress(err) || attempt >= cfg.publishRetries() {
+			break
+		}
+
+		delay := backoff(cfg.retryBaseDelay(), attempt)
+		logInfo("Zone has an operation in progress, retrying publish", cfg.logFields(logFields{
+			"zone":      cfg.ZoneName,
+			"operation": "commit",
+			"duration":  delay,
+			"error":     err,
+		}))
+		if c.sleep(delay) != nil {
+			break
+		}
+	}
+	fields["duration"] = time.Since(start)
+	if response.JobId != 0 {
+		fields["job_id"] = response.JobId
+	}
+	// A publish retried after it went through, or one for changes published
+	// along with those of another challenge, has nothing left to publish.
+	if isNoPendingChanges(err) {
+		logVerbose("Zone has no pending changes, nothing to publish", fields)
+		return nil
+	}
 	if err != nil {
-		klog.Error("Error committing changes to zone, error: ", err)
+		withDynMessages(fields, err)
+		logError("Error committing changes to zone", fields)
 		return err
-	} else {
-		klog.Info(response)
 	}
+	logVerbose("Committed changes to zone", fields)
+
+	if cfg.ConfirmPublish {
+		if err := c.confirmPublish(cfg, ch.ResourceNamespace, serial); err != nil {
+			fields["error"] = err
+			logError("Error confirming zone publish", fields)
+			return err
+		}
+	}
+	c.activity.record(cfg.ZoneName, time.Now())
 
 	return nil
 }
+
+// publish makes a single attempt at publishing the zone of cfg, failing if
+// Dyn reports anything but success.
+func (c *dynDNSProviderSolver) publish(cfg *dynDNSProviderConfig, namespace string, req *ZonePublishRequest) (ZonePublishResponse, error) {
+	link := buildZoneLink(cfg.ZoneName)
+	lock := c.zoneLock(cfg.ZoneName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	response := ZonePublishResponse{}
+	if err := c.doRequest(cfg, namespace, "PUT", link, req, &response); err != nil {
+		return response, err
+	}
+	return response, authorizationError(checkStatus(response.ResponseBlock))
+}
@@ -1,10 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/jetstack/cert-manager/test/acme/dns"
+	corev1 "k8s.io/api/core/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+
+	"github.com/nesv/go-dynect/dynect"
 )
 
 var (
@@ -24,3 +44,1809 @@ func TestRunsSuite(t *testing.T) {
 
 	fixture.RunConformance(t)
 }
+
+const testConfigJSON = `{
+	"customerName": "customer",
+	"username": "user",
+	"zonename": "example.com",
+	"propagationDelay": "1ms",
+	"passwordSecretRef": {"name": "dyndns-password", "key": "password"}
+}`
+
+// fakeDyn is an in-memory stand in for the parts of the Dyn REST API used by
+// the solver. Tests use it as the solver's transport, or serve it over HTTP.
+type fakeDyn struct {
+	mu        sync.Mutex
+	records   map[string]string // record link -> TXT data
+	nextID    int
+	requests  []string
+	payloads  []string // request body of each entry in requests
+	publishes int
+	// pending holds the links of the record changes not yet published.
+	pending []string
+	// failures makes requests, keyed by method and path, fail with the
+	// given HTTP status code.
+	failures map[string]int
+	// responses answers requests, keyed by method and path, with the given
+	// JSON body instead of the fake's own, sent with the status code from
+	// failures or 200.
+	responses map[string]string
+	// handle, when set, sees every request before the fake and may answer
+	// it with a response or an error. Returning neither leaves the request
+	// to the fake.
+	handle func(r *http.Request) (*http.Response, error)
+}
+
+func newFakeDyn() *fakeDyn {
+	return &fakeDyn{records: make(map[string]string)}
+}
+
+func (f *fakeDyn) RoundTrip(r *http.Request) (*http.Response, error) {
+	var payload []byte
+	if r.Body != nil {
+		var err error
+		if payload, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/REST/")
+	key := r.Method + " " + path
+	f.mu.Lock()
+	f.requests = append(f.requests, key)
+	f.payloads = append(f.payloads, string(payload))
+	handle := f.handle
+	f.mu.Unlock()
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	if handle != nil {
+		if resp, err := handle(r); resp != nil || err != nil {
+			return resp, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if body, ok := f.responses[key]; ok {
+		code, failed := f.failures[key]
+		if !failed {
+			code = http.StatusOK
+		}
+		return f.respondJSON(code, body), nil
+	}
+	if code, ok := f.failures[key]; ok {
+		return f.respond(code, nil)
+	}
+
+	switch {
+	case path == "Session":
+		return f.respond(http.StatusOK, map[string]interface{}{"token": "token"})
+	case strings.HasPrefix(path, "Zone/") && r.Method == "GET":
+		return f.respond(http.StatusOK, map[string]interface{}{"zone": strings.Trim(strings.TrimPrefix(path, "Zone/"), "/"), "serial": f.publishes})
+	case strings.HasPrefix(path, "Zone/") && r.Method == "PUT":
+		f.publishes++
+		f.pending = nil
+		return f.respond(http.StatusOK, map[string]interface{}{})
+	case strings.HasPrefix(path, "ZoneChanges/"):
+		changes := []map[string]string{}
+		for _, link := range f.pending {
+			changes = append(changes, map[string]string{"rdata_type": "TXT", "record": link})
+		}
+		if r.Method == "DELETE" {
+			f.pending = nil
+		}
+		return f.respond(http.StatusOK, changes)
+	case strings.HasPrefix(path, "TXTRecord/") && strings.HasSuffix(path, "/"):
+		if r.Method == "POST" {
+			var req struct {
+				RData struct {
+					TxtData string `json:"txtdata"`
+				} `json:"rdata"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return nil, err
+			}
+			f.nextID++
+			link := fmt.Sprintf("%s%d", path, f.nextID)
+			f.records[link] = req.RData.TxtData
+			f.pending = append(f.pending, link)
+			return f.respond(http.StatusOK, map[string]interface{}{})
+		}
+		var uris []string
+		for link := range f.records {
+			if strings.HasPrefix(link, path) {
+				uris = append(uris, "/REST/"+link)
+			}
+		}
+		if len(uris) == 0 {
+			return f.respond(http.StatusNotFound, nil)
+		}
+		sort.Strings(uris)
+		return f.respond(http.StatusOK, uris)
+	case strings.HasPrefix(path, "TXTRecord/"):
+		txt, ok := f.records[path]
+		if !ok {
+			return f.respond(http.StatusNotFound, nil)
+		}
+		if r.Method == "DELETE" {
+			delete(f.records, path)
+			f.pending = append(f.pending, path)
+			return f.respond(http.StatusOK, map[string]interface{}{})
+		}
+		if r.Method == "PUT" {
+			var req struct {
+				RData struct {
+					TxtData string `json:"txtdata"`
+				} `json:"rdata"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return nil, err
+			}
+			f.records[path] = req.RData.TxtData
+			f.pending = append(f.pending, path)
+			return f.respond(http.StatusOK, map[string]interface{}{})
+		}
+		return f.respond(http.StatusOK, map[string]interface{}{
+			"rdata": map[string]string{"txtdata": txt},
+		})
+	}
+
+	return f.respond(http.StatusNotFound, nil)
+}
+
+func (f *fakeDyn) respond(code int, data interface{}) (*http.Response, error) {
+	status := "success"
+	if code != http.StatusOK {
+		status = "failure"
+	}
+	body, err := json.Marshal(map[string]interface{}{"status": status, "data": data})
+	if err != nil {
+		return nil, err
+	}
+	return f.respondJSON(code, string(body)), nil
+}
+
+// respondJSON returns a response with the given status code and JSON body.
+func (f *fakeDyn) respondJSON(code int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    code,
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// ServeHTTP serves the fake over HTTP, for tests of the solver against a Dyn
+// API endpoint.
+func (f *fakeDyn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp, err := f.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// endpoints returns the method and path of the requests other than the
+// session handling.
+func (f *fakeDyn) endpoints() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var endpoints []string
+	for _, req := range f.requests {
+		if !strings.HasSuffix(req, " Session") {
+			endpoints = append(endpoints, req)
+		}
+	}
+	return endpoints
+}
+
+// sent returns the bodies of the requests sent to endpoint.
+func (f *fakeDyn) sent(endpoint string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var payloads []string
+	for i, req := range f.requests {
+		if req == endpoint {
+			payloads = append(payloads, f.payloads[i])
+		}
+	}
+	return payloads
+}
+
+// payload returns the body of the first request sent to endpoint.
+func (f *fakeDyn) payload(endpoint string) string {
+	if payloads := f.sent(endpoint); len(payloads) > 0 {
+		return payloads[0]
+	}
+	return ""
+}
+
+// txtValues returns the sorted TXT values stored at the given name.
+func (f *fakeDyn) txtValues(zone, fqdn string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var values []string
+	for link, txt := range f.records {
+		if strings.HasPrefix(link, fmt.Sprintf("TXTRecord/%s/%s/", zone, fqdn)) {
+			values = append(values, txt)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+const (
+	testRecordsLink = "TXTRecord/example.com/_acme-challenge.example.com/"
+	testRecordLink  = testRecordsLink + "1"
+	testSuccessJSON = `{"status": "success"}`
+)
+
+func newTestSolver(transport http.RoundTripper) *dynDNSProviderSolver {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "dyndns-password", Namespace: "default"},
+		Data: map[string][]byte{
+			"password": []byte("secret"),
+			"username": []byte("secret-user"),
+		},
+	}
+	return &dynDNSProviderSolver{
+		client:    fake.NewSimpleClientset(secret),
+		transport: transport,
+	}
+}
+
+func newTestChallenge() *v1alpha1.ChallengeRequest {
+	return &v1alpha1.ChallengeRequest{
+		DNSName:           "example.com",
+		Key:               "challenge-key",
+		ResourceNamespace: "default",
+		ResolvedFQDN:      "_acme-challenge.example.com",
+		ResolvedZone:      "example.com",
+		Config:            &extapi.JSON{Raw: []byte(testConfigJSON)},
+	}
+}
+
+// withConfig returns ch with the given fields set in its solver config.
+func withConfig(t *testing.T, ch *v1alpha1.ChallengeRequest, fields map[string]interface{}) *v1alpha1.ChallengeRequest {
+	cfg := map[string]interface{}{}
+	if err := json.Unmarshal(ch.Config.Raw, &cfg); err != nil {
+		t.Fatalf("unexpected error decoding config: %v", err)
+	}
+	for k, v := range fields {
+		cfg[k] = v
+	}
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error encoding config: %v", err)
+	}
+	ch.Config = &extapi.JSON{Raw: raw}
+	return ch
+}
+
+func TestDynClientFailedLogin(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.failures = map[string]int{"POST Session": http.StatusInternalServerError}
+	dyn.responses = map[string]string{"POST Session": "login failed"}
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"retryBaseDelay": "1ms"})
+
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	dynClient, err := solver.dynClient(&cfg, "default")
+	if err == nil {
+		t.Fatal("expected an error when the Session POST fails")
+	}
+	if dynClient != nil {
+		t.Errorf("expected no client when the Session POST fails, got %v", dynClient)
+	}
+
+	if err := solver.Present(ch); err == nil {
+		t.Error("expected Present to fail when the Session POST fails")
+	}
+}
+
+func TestResolveGroupName(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "env", env: "acme.example.com", want: "acme.example.com"},
+		{name: "flag", args: []string{"--group-name=acme.example.org"}, want: "acme.example.org"},
+		{name: "separate flag value", args: []string{"--tls-cert-file=/tls/tls.crt", "--group-name", "acme.example.org"}, want: "acme.example.org"},
+		{name: "flag overrides env", args: []string{"--group-name=acme.example.org"}, env: "acme.example.com", want: "acme.example.org"},
+		{name: "neither", args: []string{"--tls-cert-file=/tls/tls.crt"}, wantErr: true},
+		{name: "empty flag", args: []string{"--group-name="}, env: "acme.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveGroupName(tt.args, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expected group name %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestModuleVersion(t *testing.T) {
+	if got := moduleVersion("example.com/not-a-dependency"); got != "unknown" {
+		t.Errorf("expected an unknown version, got %q", got)
+	}
+}
+
+func TestSolverName(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want string
+	}{
+		{name: "default", want: "dyndns"},
+		{name: "env", env: "dyndns-staging", want: "dyndns-staging"},
+		{name: "flag overrides env", args: []string{"--solver-name", "dyndns-prod"}, env: "dyndns-staging", want: "dyndns-prod"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			solver := &dynDNSProviderSolver{name: resolveSolverName(tt.args, tt.env)}
+			if got := solver.Name(); got != tt.want {
+				t.Errorf("expected solver name %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateTTL(t *testing.T) {
+	tests := []struct {
+		ttl     int
+		wantErr bool
+	}{
+		{ttl: 0},
+		{ttl: 30},
+		{ttl: 86400},
+		{ttl: 29, wantErr: true},
+		{ttl: 86401, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadConfig(newTestChallenge().Config)
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		cfg.TTL = tt.ttl
+
+		err = (&dynDNSProviderSolver{}).validate(&cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validate with ttl %d: got error %v, want error %t", tt.ttl, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateCustomerName(t *testing.T) {
+	tests := []struct {
+		customerName string
+		wantErr      bool
+	}{
+		{customerName: "dyn_customer_name"},
+		{customerName: "acme-corp"},
+		{customerName: "ops@example.com", wantErr: true},
+		{customerName: "acme corp", wantErr: true},
+		{customerName: "acme\t", wantErr: true},
+		{customerName: strings.Repeat("a", maxCustomerNameLength+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadConfig(newTestChallenge().Config)
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		cfg.CustomerName = tt.customerName
+
+		err = (&dynDNSProviderSolver{}).validate(&cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validate with customerName %q: got error %v, want error %t", tt.customerName, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCleanUpDeletesOnlyMatchingRecord(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	other := newTestChallenge()
+	other.Key = "other-key"
+	for _, ch := range []*v1alpha1.ChallengeRequest{newTestChallenge(), other} {
+		if err := solver.Present(ch); err != nil {
+			t.Fatalf("unexpected error presenting %q: %v", ch.Key, err)
+		}
+	}
+
+	if err := solver.CleanUp(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 || got[0] != `"other-key"` {
+		t.Errorf("expected only the other challenge record to remain, got %v", got)
+	}
+
+	publishes := dyn.publishes
+	if err := solver.CleanUp(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error cleaning up an already removed record: %v", err)
+	}
+	if dyn.publishes != publishes {
+		t.Errorf("expected no publish when there is nothing to clean up")
+	}
+}
+
+func TestMaxRecordsPerName(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		wantErr bool
+	}{
+		{name: "unlimited"},
+		{name: "within limit", max: 3},
+		{name: "over limit", max: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			solver := newTestSolver(dyn)
+			for _, key := range []string{"key-a", "key-b", "key-c"} {
+				ch := newTestChallenge()
+				ch.Key = key
+				if err := solver.Present(ch); err != nil {
+					t.Fatalf("unexpected error presenting %q: %v", key, err)
+				}
+			}
+
+			ch := newTestChallenge()
+			ch.Key = "key-a"
+			withConfig(t, ch, map[string]interface{}{"maxRecordsPerName": tt.max})
+			err := solver.CleanUp(ch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+
+			want := 2
+			if tt.wantErr {
+				want = 3
+			}
+			if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != want {
+				t.Errorf("expected %d records to remain, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestConcurrentChallengesForOneName(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	keys := []string{"key-a", "key-b"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(keys))
+	for _, key := range keys {
+		ch := newTestChallenge()
+		ch.Key = key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- solver.Present(ch)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error presenting: %v", err)
+		}
+	}
+
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 2 || got[0] != `"key-a"` || got[1] != `"key-b"` {
+		t.Fatalf("expected records for both keys, got %v", got)
+	}
+
+	for i, key := range keys {
+		ch := newTestChallenge()
+		ch.Key = key
+		if err := solver.CleanUp(ch); err != nil {
+			t.Fatalf("unexpected error cleaning up %q: %v", key, err)
+		}
+		if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != len(keys)-i-1 {
+			t.Errorf("expected %d records after cleaning up %q, got %v", len(keys)-i-1, key, got)
+		}
+	}
+}
+
+func TestWildcardChallenges(t *testing.T) {
+	tests := []struct {
+		name         string
+		dnsName      string
+		resolvedFQDN string
+	}{
+		{name: "apex", dnsName: "example.com", resolvedFQDN: "_acme-challenge.example.com."},
+		{name: "wildcard", dnsName: "*.example.com", resolvedFQDN: "_acme-challenge.example.com."},
+		{name: "wildcard label left in the name", dnsName: "*.example.com", resolvedFQDN: "_acme-challenge.*.example.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			solver := newTestSolver(dyn)
+			ch := newTestChallenge()
+			ch.DNSName = tt.dnsName
+			ch.ResolvedFQDN = tt.resolvedFQDN
+			ch.ResolvedZone = "example.com."
+
+			if err := solver.Present(ch); err != nil {
+				t.Fatalf("unexpected error presenting: %v", err)
+			}
+			if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+				t.Fatalf("expected a record at _acme-challenge.example.com, got %v", got)
+			}
+			if err := solver.CleanUp(ch); err != nil {
+				t.Fatalf("unexpected error cleaning up: %v", err)
+			}
+			if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 0 {
+				t.Errorf("expected the record to be deleted, got %v", got)
+			}
+		})
+	}
+
+	if got := normalizeWildcard(&v1alpha1.ChallengeRequest{ResolvedFQDN: "_acme-challenge.*.sub.example.com."}).ResolvedFQDN; got != "_acme-challenge.sub.example.com." {
+		t.Errorf("expected the wildcard label to be dropped, got %q", got)
+	}
+}
+
+func TestWildcardAndApexChallengesTogether(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	apex := newTestChallenge()
+	wildcard := newTestChallenge()
+	wildcard.DNSName = "*.example.com"
+	wildcard.Key = "wildcard-key"
+
+	for _, ch := range []*v1alpha1.ChallengeRequest{apex, wildcard} {
+		if err := solver.Present(ch); err != nil {
+			t.Fatalf("unexpected error presenting %s: %v", ch.DNSName, err)
+		}
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 2 {
+		t.Fatalf("expected records for both challenges, got %v", got)
+	}
+
+	if err := solver.CleanUp(wildcard); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 || got[0] != `"challenge-key"` {
+		t.Errorf("expected only the apex record to be left, got %v", got)
+	}
+}
+
+func TestUpdateInPlace(t *testing.T) {
+	tests := []struct {
+		name          string
+		updateInPlace bool
+		stale         []string
+		want          []string
+		wantUpdate    bool
+	}{
+		{name: "create by default", stale: []string{`"old-key"`}, want: []string{`"challenge-key"`, `"old-key"`}},
+		{name: "update the only record", updateInPlace: true, stale: []string{`"old-key"`}, want: []string{`"challenge-key"`}, wantUpdate: true},
+		{name: "create without records", updateInPlace: true, want: []string{`"challenge-key"`}},
+		{name: "create next to several records", updateInPlace: true, stale: []string{`"a"`, `"b"`}, want: []string{`"a"`, `"b"`, `"challenge-key"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			for i, value := range tt.stale {
+				dyn.records[fmt.Sprintf("%s%d", testRecordsLink, 100+i)] = value
+			}
+			solver := newTestSolver(dyn)
+
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{"updateInPlace": tt.updateInPlace})
+			if err := solver.Present(ch); err != nil {
+				t.Fatalf("unexpected error presenting: %v", err)
+			}
+			if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected records %v, got %v", tt.want, got)
+			}
+
+			var updated bool
+			for _, r := range dyn.requests {
+				if strings.HasPrefix(r, "PUT TXTRecord/") {
+					updated = true
+				}
+			}
+			if updated != tt.wantUpdate {
+				t.Errorf("expected a record update to be %v, got requests %v", tt.wantUpdate, dyn.requests)
+			}
+		})
+	}
+}
+
+func TestRecordNameMappings(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	ch := newTestChallenge()
+	ch.ResolvedFQDN = "_acme-challenge.www.example.com."
+	ch.ResolvedZone = "example.com."
+	withConfig(t, ch, map[string]interface{}{
+		"zonename": "example.internal",
+		"recordNameMappings": []map[string]string{
+			{"from": "example.org", "to": "other.internal"},
+			{"from": "example.com", "to": "ext.example.internal"},
+		},
+	})
+
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	if ch.ResolvedFQDN != "_acme-challenge.www.example.com." {
+		t.Errorf("expected the challenge not to be modified, got fqdn %q", ch.ResolvedFQDN)
+	}
+	if got := dyn.txtValues("example.internal", "_acme-challenge.www.ext.example.internal"); len(got) != 1 {
+		t.Errorf("expected the record at the mapped name, got %v", got)
+	}
+
+	if err := solver.CleanUp(ch); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+	if got := dyn.txtValues("example.internal", "_acme-challenge.www.ext.example.internal"); len(got) != 0 {
+		t.Errorf("expected the record at the mapped name to be deleted, got %v", got)
+	}
+}
+
+func TestZoneAllowlist(t *testing.T) {
+	tests := []struct {
+		name       string
+		solverList []string
+		configList []string
+		wantDenied bool
+	}{
+		{name: "no allowlist"},
+		{name: "allowed by config", configList: []string{"example.org", "example.com."}},
+		{name: "denied by config", configList: []string{"example.org"}, wantDenied: true},
+		{name: "allowed by solver", solverList: []string{"example.com"}},
+		{name: "denied by solver", solverList: []string{"example.org"}, configList: []string{"example.com"}, wantDenied: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			solver := newTestSolver(dyn)
+			solver.zoneAllowlist = tt.solverList
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{"zoneAllowlist": tt.configList})
+
+			presentErr := solver.Present(ch)
+			cleanUpErr := solver.CleanUp(ch)
+			for _, err := range []error{presentErr, cleanUpErr} {
+				if tt.wantDenied != (err != nil && strings.Contains(err.Error(), "not in the zone allowlist")) {
+					t.Errorf("got error %v, want denied %t", err, tt.wantDenied)
+				}
+			}
+			if tt.wantDenied && len(dyn.requests) > 0 {
+				for _, r := range dyn.requests {
+					if !strings.HasPrefix(r, "GET ") && !strings.HasSuffix(r, " Session") {
+						t.Errorf("expected no changes to a denied zone, got %s", r)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPresentIsIdempotent(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	for i := 0; i < 2; i++ {
+		if err := solver.Present(newTestChallenge()); err != nil {
+			t.Fatalf("unexpected error presenting (attempt %d): %v", i+1, err)
+		}
+	}
+
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+		t.Errorf("expected exactly one record, got %v", got)
+	}
+	// The second Present finds the record published, with nothing pending.
+	if dyn.publishes != 1 {
+		t.Errorf("expected a single publish, got %d", dyn.publishes)
+	}
+}
+
+func TestPresentRetriedAfterFailedPublish(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.failures = map[string]int{"PUT Zone/example.com/": http.StatusServiceUnavailable}
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"maxRetries": -1})
+
+	var commitErr *CommitFailedAfterCreateError
+	if err := solver.Present(ch); !errors.As(err, &commitErr) {
+		t.Fatalf("expected the publish to fail, got %v", err)
+	}
+
+	dyn.mu.Lock()
+	dyn.failures = nil
+	dyn.mu.Unlock()
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error retrying Present: %v", err)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+		t.Errorf("expected exactly one record, got %v", got)
+	}
+	if dyn.publishes != 1 {
+		t.Errorf("expected the retried Present to publish the record, got %d publishes", dyn.publishes)
+	}
+}
+
+func TestZoneNameDerivedFromResolvedZone(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"zonename": ""})
+	ch.ResolvedZone = "example.com."
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+
+	found := false
+	for _, req := range dyn.requests {
+		if req == "PUT Zone/example.com/" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the derived zone to be published, got requests %v", dyn.requests)
+	}
+}
+
+func TestLoadConfigPropagationDelay(t *testing.T) {
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"propagationDelay": "2s"}`)})
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if got := cfg.propagationDelay(); got != 2*time.Second {
+		t.Errorf("expected a propagation delay of 2s, got %v", got)
+	}
+
+	cfg, err = loadConfig(&extapi.JSON{Raw: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if got := cfg.propagationDelay(); got != defaultPropagationDelay {
+		t.Errorf("expected the default propagation delay, got %v", got)
+	}
+
+	if _, err := loadConfig(&extapi.JSON{Raw: []byte(`{"propagationDelay": "soon"}`)}); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{name: "valid", raw: `{"zonename": "example.com", "ttl": 120}`},
+		{name: "unknown field", raw: `{"zonenamee": "example.com"}`, wantErr: `unknown field "zonenamee"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(&extapi.JSON{Raw: []byte(tt.raw)})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if cfg.ZoneName != "example.com" || cfg.TTL != 120 {
+					t.Errorf("unexpected config %+v", cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func FuzzLoadConfig(f *testing.F) {
+	f.Add([]byte(testConfigJSON))
+	f.Add([]byte(`{"zones": [{"name": "example.com"}, {"name": "example.org"}], "credentialsSecretRef": {"name": "dyndns"}}`))
+	f.Add([]byte(`{"zonename": "example.com", "ttl": 120, "retryBaseDelay": "250ms", "headers": {"X-Tenant": "acme"}, "autoCommit": false}`))
+	f.Add([]byte(`{"commitNotesTemplate": "{{.FQDN}} by {{.Version}}", "requestsPerSecond": 2.5}`))
+	f.Add([]byte(`{"zonename": "example.com"`))
+	f.Add([]byte(`{"ttl": "60"}`))
+	f.Add([]byte(`{"propagationDelay": 2}`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(`null`))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		cfg, err := loadConfig(&extapi.JSON{Raw: raw})
+		if err != nil {
+			if err.Error() == "" {
+				t.Fatal("expected a descriptive error")
+			}
+			return
+		}
+		// A decoded config must be safe to validate, whether or not it is
+		// valid.
+		(&dynDNSProviderSolver{}).validate(&cfg)
+	})
+}
+
+func TestLoadConfigEnvDefaults(t *testing.T) {
+	t.Setenv("DEFAULT_USERNAME", "env-user")
+	t.Setenv("DEFAULT_CUSTOMER_NAME", "env-customer")
+	t.Setenv("DEFAULT_ZONE_NAME", "env.example.com")
+
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"username": "issuer-user"}`)})
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if cfg.Username != "issuer-user" {
+		t.Errorf("expected the issuer username to take precedence, got %q", cfg.Username)
+	}
+	if cfg.CustomerName != "env-customer" {
+		t.Errorf("expected the customer name from the environment, got %q", cfg.CustomerName)
+	}
+
+	cfg, err = loadConfig(nil)
+	if err != nil {
+		t.Fatalf("unexpected error loading an empty config: %v", err)
+	}
+	if cfg.Username != "env-user" || cfg.CustomerName != "env-customer" {
+		t.Errorf("expected the defaults from the environment, got %+v", cfg)
+	}
+
+	// The default zone only applies when there is no zone to select.
+	tests := []struct {
+		name  string
+		zones []dynZoneConfig
+		zone  string
+		want  string
+	}{
+		{name: "resolved zone", zone: "example.org.", want: "example.org"},
+		{name: "configured zones", zones: []dynZoneConfig{{Name: "example.com"}}, want: "example.com"},
+		{name: "no zone", want: "env.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := dynDNSProviderConfig{Zones: tt.zones}
+			resolveZone(&cfg, &v1alpha1.ChallengeRequest{ResolvedFQDN: "_acme-challenge.example.com.", ResolvedZone: tt.zone})
+			if cfg.ZoneName != tt.want {
+				t.Errorf("expected zone %q, got %q", tt.want, cfg.ZoneName)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSample(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/dyndns/config.json.sample")
+	if err != nil {
+		t.Fatalf("unexpected error reading sample config: %v", err)
+	}
+
+	cfg, err := loadConfig(&extapi.JSON{Raw: raw})
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if cfg.CustomerName != "dyn_customer_name" || cfg.Username != "dyn_username" || cfg.ZoneName != "dyn_zonename" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if ref := cfg.PasswordSecretRef; ref.Name != "dyndns-password" || ref.Key != "password" {
+		t.Errorf("unexpected passwordSecretRef %+v", ref)
+	}
+
+	cfg, err = loadConfig(nil)
+	if err != nil {
+		t.Fatalf("unexpected error loading an empty config: %v", err)
+	}
+	if cfg.ZoneName != "" {
+		t.Errorf("expected an empty config, got %+v", cfg)
+	}
+}
+
+// TestChartAPIVersions checks that the chart only uses API versions served by
+// Kubernetes 1.22 and later, and by cert-manager v1.
+func TestChartAPIVersions(t *testing.T) {
+	want := map[string]string{
+		"Deployment":         "apps/v1",
+		"APIService":         "apiregistration.k8s.io/v1",
+		"Issuer":             "cert-manager.io/v1",
+		"Certificate":        "cert-manager.io/v1",
+		"ClusterRole":        "rbac.authorization.k8s.io/v1",
+		"ClusterRoleBinding": "rbac.authorization.k8s.io/v1",
+		"RoleBinding":        "rbac.authorization.k8s.io/v1",
+	}
+	templates, err := filepath.Glob("deploy/cert-manager-webhook-dyndns/templates/*.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error listing the chart templates: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, name := range templates {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %v", name, err)
+		}
+		var apiVersion string
+		for _, line := range strings.Split(string(data), "\n") {
+			switch {
+			case strings.HasPrefix(line, "apiVersion: "):
+				apiVersion = strings.TrimPrefix(line, "apiVersion: ")
+			case strings.HasPrefix(line, "kind: "):
+				kind := strings.TrimPrefix(line, "kind: ")
+				seen[kind] = true
+				if v, ok := want[kind]; ok && apiVersion != v {
+					t.Errorf("%s: expected %s to use %s, got %s", filepath.Base(name), kind, v, apiVersion)
+				}
+			}
+		}
+	}
+	if !seen["Deployment"] {
+		t.Error("expected the chart to define a Deployment")
+	}
+}
+
+func TestUsernameSecretRef(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"username":          "",
+		"usernameSecretRef": map[string]string{"name": "dyndns-password", "key": "username"},
+	})
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	var login dynect.LoginBlock
+	if err := json.Unmarshal([]byte(dyn.payload("POST Session")), &login); err != nil {
+		t.Fatalf("unexpected error decoding the login: %v", err)
+	}
+	if login.Username != "secret-user" {
+		t.Errorf("expected to log in with the username from the secret, got %q", login.Username)
+	}
+}
+
+func TestCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	emptyFile := filepath.Join(dir, "empty")
+	outsideFile := filepath.Join(t.TempDir(), "token")
+	for path, content := range map[string]string{
+		usernameFile: "file-user\n",
+		passwordFile: "file-password\n",
+		emptyFile:    "",
+		outsideFile:  "service-account-token",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	linkFile := filepath.Join(dir, "link")
+	if err := os.Symlink(outsideFile, linkFile); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		config           map[string]interface{}
+		noCredentialsDir bool
+		wantUsername     string
+		wantPassword     string
+		wantErr          bool
+	}{
+		{
+			name: "files",
+			config: map[string]interface{}{
+				"username":          "",
+				"usernameFile":      usernameFile,
+				"passwordSecretRef": map[string]string{},
+				"passwordFile":      passwordFile,
+			},
+			wantUsername: "file-user",
+			wantPassword: "file-password",
+		},
+		{
+			name: "secret ref takes precedence",
+			config: map[string]interface{}{
+				"usernameFile": usernameFile,
+				"passwordFile": passwordFile,
+				"usernameSecretRef": map[string]string{
+					"name": "dyndns-password",
+					"key":  "username",
+				},
+			},
+			wantUsername: "secret-user",
+			wantPassword: "secret",
+		},
+		{
+			name: "missing file",
+			config: map[string]interface{}{
+				"passwordSecretRef": map[string]string{},
+				"passwordFile":      filepath.Join(dir, "missing"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty password file",
+			config: map[string]interface{}{
+				"passwordSecretRef": map[string]string{},
+				"passwordFile":      emptyFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "file outside the credentials directory",
+			config: map[string]interface{}{
+				"passwordSecretRef": map[string]string{},
+				"passwordFile":      outsideFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "path escaping the credentials directory",
+			config: map[string]interface{}{
+				"passwordSecretRef": map[string]string{},
+				"passwordFile":      filepath.Join(dir, "..", filepath.Base(filepath.Dir(outsideFile)), "token"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "symlink out of the credentials directory",
+			config: map[string]interface{}{
+				"passwordSecretRef": map[string]string{},
+				"passwordFile":      linkFile,
+			},
+			wantErr: true,
+		},
+		{
+			name: "no credentials directory",
+			config: map[string]interface{}{
+				"passwordSecretRef": map[string]string{},
+				"passwordFile":      passwordFile,
+			},
+			noCredentialsDir: true,
+			wantErr:          true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			solver := newTestSolver(dyn)
+			if !tt.noCredentialsDir {
+				solver.credentialsDir = dir
+			}
+
+			err := solver.Present(withConfig(t, newTestChallenge(), tt.config))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error presenting: %v", err)
+			}
+			var login dynect.LoginBlock
+			if err := json.Unmarshal([]byte(dyn.payload("POST Session")), &login); err != nil {
+				t.Fatalf("unexpected error decoding the login: %v", err)
+			}
+			if login.Username != tt.wantUsername || login.Password != tt.wantPassword {
+				t.Errorf("expected to log in as %q with %q, got %q with %q", tt.wantUsername, tt.wantPassword, login.Username, login.Password)
+			}
+		})
+	}
+}
+
+func TestSolverRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		records       map[string]string
+		run           func(*dynDNSProviderSolver, *dynDNSProviderConfig, *v1alpha1.ChallengeRequest) error
+		wantEndpoints []string
+		wantPayloads  map[string]string
+	}{
+		{
+			name: "createRecord creates and publishes a new record",
+			run: func(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+				_, err := c.createRecord(cfg, ch)
+				return err
+			},
+			wantEndpoints: []string{
+				"GET " + testRecordsLink,
+				"POST " + testRecordsLink,
+				"PUT Zone/example.com/",
+			},
+			wantPayloads: map[string]string{
+				"POST " + testRecordsLink: `{"rdata":{"txtdata":"\"challenge-key\""},"ttl":"60"}`,
+			},
+		},
+		{
+			name:    "createRecord skips an existing record with nothing pending",
+			records: map[string]string{testRecordLink: "challenge-key"},
+			run: func(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+				_, err := c.createRecord(cfg, ch)
+				return err
+			},
+			wantEndpoints: []string{
+				"GET " + testRecordsLink,
+				"GET " + testRecordLink,
+				"GET ZoneChanges/example.com/",
+			},
+		},
+		{
+			name:    "CleanUp deletes the matching record and publishes",
+			records: map[string]string{testRecordLink: "challenge-key"},
+			run: func(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+				return c.CleanUp(ch)
+			},
+			wantEndpoints: []string{
+				"GET " + testRecordsLink,
+				"GET " + testRecordLink,
+				"DELETE " + testRecordLink,
+				"PUT Zone/example.com/",
+			},
+		},
+		{
+			name: "commit publishes the zone",
+			run: func(c *dynDNSProviderSolver, cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+				return commit(c, cfg, ch)
+			},
+			wantEndpoints: []string{
+				"PUT Zone/example.com/",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			for link, txt := range tt.records {
+				dyn.records[link] = txt
+			}
+			solver := newTestSolver(dyn)
+			ch := newTestChallenge()
+			cfg, err := loadConfig(ch.Config)
+			if err != nil {
+				t.Fatalf("unexpected error loading config: %v", err)
+			}
+
+			if err := tt.run(solver, &cfg, ch); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := dyn.endpoints(); strings.Join(got, "\n") != strings.Join(tt.wantEndpoints, "\n") {
+				t.Errorf("unexpected requests\ngot:  %v\nwant: %v", got, tt.wantEndpoints)
+			}
+			for endpoint, want := range tt.wantPayloads {
+				if got := dyn.payload(endpoint); got != want {
+					t.Errorf("unexpected payload for %s\ngot:  %s\nwant: %s", endpoint, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrailingDotsAreNormalized(t *testing.T) {
+	tests := []struct {
+		name, zone, fqdn, zoneName string
+	}{
+		{name: "without trailing dots", zone: "example.com", fqdn: "_acme-challenge.example.com", zoneName: "example.com"},
+		{name: "with trailing dots", zone: "example.com.", fqdn: "_acme-challenge.example.com.", zoneName: "example.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			solver := newTestSolver(dyn)
+
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{"zonename": tt.zoneName})
+			ch.ResolvedZone = tt.zone
+			ch.ResolvedFQDN = tt.fqdn
+			if err := solver.Present(ch); err != nil {
+				t.Fatalf("unexpected error presenting: %v", err)
+			}
+			if err := solver.CleanUp(ch); err != nil {
+				t.Fatalf("unexpected error cleaning up: %v", err)
+			}
+
+			want := []string{
+				"GET " + testRecordsLink,
+				"POST " + testRecordsLink,
+				"PUT Zone/example.com/",
+				"GET " + testRecordsLink,
+				"GET " + testRecordLink,
+				"DELETE " + testRecordLink,
+				"PUT Zone/example.com/",
+			}
+			if got := dyn.endpoints(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("unexpected requests\ngot:  %v\nwant: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestEmptyPassword(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	solver.client = fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "dyndns-password", Namespace: "default"},
+		Data:       map[string][]byte{"password": {}},
+	})
+
+	cfg, err := loadConfig(newTestChallenge().Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	_, err = solver.dynClient(&cfg, "default")
+	if want := `password value at key "password" in secret "default/dyndns-password" is empty`; err == nil || err.Error() != want {
+		t.Errorf("unexpected error\ngot:  %v\nwant: %s", err, want)
+	}
+	if len(dyn.requests) != 0 {
+		t.Errorf("expected no Dyn requests, got %v", dyn.requests)
+	}
+}
+
+func TestMissingSecretKey(t *testing.T) {
+	solver := newTestSolver(newFakeDyn())
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"passwordSecretRef": map[string]string{"name": "dyndns-password", "key": "missing"},
+	})
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	_, err = solver.dynClient(&cfg, "default")
+	keyErr, ok := err.(*SecretKeyNotFoundError)
+	if !ok {
+		t.Fatalf("expected a *SecretKeyNotFoundError, got %T: %v", err, err)
+	}
+	if keyErr.Name != "dyndns-password" || keyErr.Namespace != "default" || keyErr.Key != "missing" {
+		t.Errorf("unexpected error details: %+v", keyErr)
+	}
+	if want := `Key "missing" not found in secret "default/dyndns-password"`; err.Error() != want {
+		t.Errorf("unexpected error message\ngot:  %s\nwant: %s", err, want)
+	}
+}
+
+func TestIncompleteChallengeRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		ch     *v1alpha1.ChallengeRequest
+		errMsg string
+	}{
+		{name: "nil", ch: nil, errMsg: "empty challenge request"},
+		{name: "empty", ch: &v1alpha1.ChallengeRequest{}, errMsg: "no solver config"},
+		{name: "no config", ch: func() *v1alpha1.ChallengeRequest {
+			ch := newTestChallenge()
+			ch.Config = nil
+			return ch
+		}(), errMsg: "no solver config"},
+		{name: "no FQDN", ch: func() *v1alpha1.ChallengeRequest {
+			ch := newTestChallenge()
+			ch.ResolvedFQDN = "."
+			return ch
+		}(), errMsg: "no ResolvedFQDN"},
+		{name: "no key", ch: func() *v1alpha1.ChallengeRequest {
+			ch := newTestChallenge()
+			ch.Key = ""
+			return ch
+		}(), errMsg: "no key"},
+		{name: "no zone", ch: func() *v1alpha1.ChallengeRequest {
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{"zonename": ""})
+			ch.ResolvedZone = ""
+			return ch
+		}(), errMsg: "empty ResolvedZone"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			solver := newTestSolver(dyn)
+
+			if err := solver.Present(tt.ch); err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("expected Present to fail with %q, got %v", tt.errMsg, err)
+			}
+			if err := solver.CleanUp(tt.ch); err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("expected CleanUp to fail with %q, got %v", tt.errMsg, err)
+			}
+			if len(dyn.requests) != 0 {
+				t.Errorf("expected no Dyn requests, got %v", dyn.requests)
+			}
+		})
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if r.Method == "POST" && r.URL.Path == "/REST/Session" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+	logins := func() []string {
+		var passwords []string
+		for _, payload := range dyn.sent("POST Session") {
+			var login dynect.LoginBlock
+			json.Unmarshal([]byte(payload), &login)
+			passwords = append(passwords, login.Password)
+		}
+		return passwords
+	}
+	load := func(namespace, secret string) dynDNSProviderConfig {
+		cfg, err := loadConfig(withConfig(t, newTestChallenge(), map[string]interface{}{
+			"passwordSecretRef": map[string]string{"name": secret, "key": "password"},
+		}).Config)
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		cfg.namespace = namespace
+		return cfg
+	}
+
+	// Concurrent calls share a single login, and later calls the session.
+	cfg := load("default", "dyndns-password")
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg := cfg
+			if _, err := solver.dynClient(&cfg, "default"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := solver.dynClient(&cfg, "default"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := logins(); len(got) != 1 {
+		t.Fatalf("expected a single login, got %v", got)
+	}
+
+	// Another namespace naming the same account does not get the session,
+	// even if its secret holds the wrong password.
+	secret := func(namespace, password string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "dyndns-password", Namespace: namespace},
+			Data:       map[string][]byte{"password": []byte(password)},
+		}
+	}
+	solver.client = fake.NewSimpleClientset(secret("default", "secret"), secret("other", "guess"))
+	other := load("other", "dyndns-password")
+	if _, err := solver.dynClient(&other, "other"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := logins(); len(got) != 2 || got[1] != "guess" {
+		t.Fatalf("expected a login with the other namespace's password, got %v", got)
+	}
+
+	// A rotated password logs in again.
+	solver.client = fake.NewSimpleClientset(secret("default", "rotated"))
+	if _, err := solver.dynClient(&cfg, "default"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := logins(); len(got) != 3 || got[2] != "rotated" {
+		t.Fatalf("expected a login with the rotated password, got %v", got)
+	}
+
+	// An evicted session logs in again.
+	solver.evictSession(&cfg)
+	if _, err := solver.dynClient(&cfg, "default"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := logins(); len(got) != 4 {
+		t.Fatalf("expected a login after the session was evicted, got %v", got)
+	}
+}
+
+func TestResolveZoneFromZoneList(t *testing.T) {
+	tests := []struct {
+		name string
+		fqdn string
+		want string
+	}{
+		{name: "apex zone", fqdn: "_acme-challenge.example.com.", want: "example.com"},
+		{name: "most specific zone", fqdn: "_acme-challenge.www.sub.example.com.", want: "sub.example.com"},
+		{name: "other zone", fqdn: "_acme-challenge.example.org", want: "example.org"},
+		{name: "no matching zone", fqdn: "_acme-challenge.example.net", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := dynDNSProviderConfig{Zones: []dynZoneConfig{
+				{Name: "example.com"},
+				{Name: "sub.example.com."},
+				{Name: "example.org"},
+			}}
+			resolveZone(&cfg, &v1alpha1.ChallengeRequest{ResolvedFQDN: tt.fqdn, ResolvedZone: "ignored.com."})
+			if cfg.ZoneName != tt.want {
+				t.Errorf("expected zone %q, got %q", tt.want, cfg.ZoneName)
+			}
+		})
+	}
+}
+
+func TestZoneTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		fqdn string
+		ttl  int
+		want int
+	}{
+		{name: "zone ttl", fqdn: "_acme-challenge.example.com.", ttl: 120, want: 300},
+		{name: "zone ttl without global ttl", fqdn: "_acme-challenge.example.org.", want: 900},
+		{name: "most specific zone without ttl", fqdn: "_acme-challenge.www.sub.example.com.", ttl: 120, want: 120},
+		{name: "default ttl", fqdn: "_acme-challenge.www.sub.example.com.", want: defaultTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := dynDNSProviderConfig{TTL: tt.ttl, Zones: []dynZoneConfig{
+				{Name: "example.com", TTL: 300},
+				{Name: "sub.example.com."},
+				{Name: "example.org.", TTL: 900},
+			}}
+			resolveZone(&cfg, &v1alpha1.ChallengeRequest{ResolvedFQDN: tt.fqdn})
+			if got := cfg.recordTTL(); got != tt.want {
+				t.Errorf("expected ttl %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	cfg := dynDNSProviderConfig{Username: "user", CustomerName: "customer", PasswordFile: "/password", Zones: []dynZoneConfig{{Name: "example.com", TTL: 10}}}
+	if err := (&dynDNSProviderSolver{}).validate(&cfg); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("expected an out of range zone ttl to be rejected, got %v", err)
+	}
+}
+
+func TestDiscardPendingOnStart(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.responses = map[string]string{"DELETE ZoneChanges/example.com/": testSuccessJSON}
+	solver := newTestSolver(dyn)
+	ch := newTestChallenge()
+	withConfig(t, ch, map[string]interface{}{"discardPendingOnStart": true})
+
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"DELETE ZoneChanges/example.com/",
+		"GET " + testRecordsLink,
+		"POST " + testRecordsLink,
+		"PUT Zone/example.com/",
+	}
+	if got := dyn.endpoints(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected requests %v, got %v", want, got)
+	}
+}
+
+func TestZoneLock(t *testing.T) {
+	solver := &dynDNSProviderSolver{}
+	lock := solver.zoneLock("example.com")
+	for _, zone := range []string{"example.com.", "Example.COM", "EXAMPLE.com."} {
+		if solver.zoneLock(zone) != lock {
+			t.Errorf("expected %q to share the lock of example.com", zone)
+		}
+	}
+	if solver.zoneLock("example.org") == lock {
+		t.Error("expected example.org not to share the lock of example.com")
+	}
+}
+
+func TestAutoCommitDisabled(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"autoCommit": false})
+
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+		t.Errorf("expected the record to be created, got %v", got)
+	}
+	if err := solver.CleanUp(ch); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 0 {
+		t.Errorf("expected the record to be deleted, got %v", got)
+	}
+	if dyn.publishes != 0 {
+		t.Errorf("expected no publishes, got %d", dyn.publishes)
+	}
+}
+
+func TestSessionPath(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.responses = map[string]string{
+		"POST v2/Login":   `{"status": "success", "data": {"token": "token"}}`,
+		"DELETE v2/Login": testSuccessJSON,
+	}
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"sessionPath": "v2/Login"})
+
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dyn.mu.Lock()
+	defer dyn.mu.Unlock()
+	if first := dyn.requests[0]; first != "POST v2/Login" {
+		t.Errorf("expected to log in at the session path, got %s", first)
+	}
+	if last := dyn.requests[len(dyn.requests)-1]; last != "DELETE v2/Login" {
+		t.Errorf("expected to log out at the session path, got %s", last)
+	}
+}
+
+func TestSkipCleanup(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"skipCleanup": true})
+
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	if err := solver.CleanUp(ch); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+		t.Errorf("expected the record to be left in place, got %v", got)
+	}
+	if dyn.publishes != 1 {
+		t.Errorf("expected only the publish of the record, got %d", dyn.publishes)
+	}
+}
+
+func TestShutdownClosesSessions(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	cfg, err := loadConfig(newTestChallenge().Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if _, err := solver.dynClient(&cfg, "default"); err != nil {
+		t.Fatalf("unexpected error logging in: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	if err := solver.Initialize(&rest.Config{}, stopCh); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	close(stopCh)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		dyn.mu.Lock()
+		last := dyn.requests[len(dyn.requests)-1]
+		dyn.mu.Unlock()
+		if last == "DELETE Session" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the cached session to be destroyed on shutdown")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	solver.sessionsMu.Lock()
+	defer solver.sessionsMu.Unlock()
+	if len(solver.sessions) != 0 {
+		t.Errorf("expected the session cache to be empty, got %d sessions", len(solver.sessions))
+	}
+}
+
+func TestCreateRecordReturnsJobID(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.responses = map[string]string{
+		"POST " + testRecordsLink: `{"status": "success", "job_id": 4242, "data": {"record_id": 1}}`,
+	}
+	solver := newTestSolver(dyn)
+	ch := newTestChallenge()
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	jobID, err := solver.createRecord(&cfg, ch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if jobID != 4242 {
+		t.Errorf("expected job ID 4242, got %d", jobID)
+	}
+}
+
+func TestFQDNOutsideZone(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"zonename": "exmaple.com"})
+
+	want := `fqdn "_acme-challenge.example.com" is not within zone "exmaple.com" (non-retryable)`
+	if err := solver.Present(ch); err == nil || err.Error() != want {
+		t.Errorf("expected Present to fail with %q, got %v", want, err)
+	}
+	if err := solver.CleanUp(ch); err == nil || err.Error() != want {
+		t.Errorf("expected CleanUp to fail with %q, got %v", want, err)
+	}
+	if got := dyn.endpoints(); len(got) != 0 {
+		t.Errorf("expected no record requests, got %v", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dyn := newFakeDyn()
+	dyn.records[testRecordLink] = "other-key"
+	solver := newTestSolver(dyn)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"dryRun":                true,
+		"discardPendingOnStart": true,
+	})
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+
+	ch.Key = "other-key"
+	if err := solver.CleanUp(ch); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+
+	for _, endpoint := range dyn.endpoints() {
+		if !strings.HasPrefix(endpoint, "GET ") {
+			t.Errorf("expected only lookups in a dry run, got %s", endpoint)
+		}
+	}
+}
+
+func TestTXTValueQuoting(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "challenge-key", want: `"challenge-key"`},
+		{value: `"challenge-key"`, want: `"challenge-key"`},
+		{value: `"`, want: `"""`},
+		{value: "", want: `""`},
+	}
+	for _, tt := range tests {
+		if got := txtValue(tt.value); got != tt.want {
+			t.Errorf("txtValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	// Records are matched on cleanup regardless of how the key and the
+	// record data returned by Dyn are quoted.
+	for _, key := range []string{"challenge-key", `"challenge-key"`} {
+		for _, data := range []string{"challenge-key", `"challenge-key"`} {
+			dyn := newFakeDyn()
+			dyn.records[testRecordLink] = data
+			ch := newTestChallenge()
+			ch.Key = key
+			if err := newTestSolver(dyn).CleanUp(ch); err != nil {
+				t.Fatalf("unexpected error cleaning up: %v", err)
+			}
+			if len(dyn.sent("DELETE "+testRecordLink)) == 0 {
+				t.Errorf("expected key %s to match record data %s", key, data)
+			}
+		}
+	}
+}
+
+func TestCredentialsSecretRef(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	solver.client = fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "dyndns-credentials", Namespace: "default"},
+		Data: map[string][]byte{
+			"username":      []byte("creds-user"),
+			"customer-name": []byte("creds-customer"),
+			"password":      []byte("creds-password"),
+		},
+	})
+
+	ch := newTestChallenge()
+	ch.Config = &extapi.JSON{Raw: []byte(`{
+		"zonename": "example.com",
+		"propagationDelay": "1ms",
+		"username": "ignored",
+		"credentialsSecretRef": {"name": "dyndns-credentials"}
+	}`)}
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `{"user_name":"creds-user","password":"creds-password","customer_name":"creds-customer"}`
+	if got := dyn.payload("POST Session"); got != want {
+		t.Errorf("expected login %s, got %s", want, got)
+	}
+}
+
+func TestEmptyResolvedZone(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	ch := newTestChallenge()
+	ch.ResolvedZone = ""
+	ch.Config = &extapi.JSON{Raw: []byte(`{
+		"customerName": "customer",
+		"username": "user",
+		"passwordSecretRef": {"name": "dyndns-password", "key": "password"}
+	}`)}
+
+	for name, solve := range map[string]func(*v1alpha1.ChallengeRequest) error{
+		"Present": solver.Present,
+		"CleanUp": solver.CleanUp,
+	} {
+		if err := solve(ch); err == nil || !strings.Contains(err.Error(), "empty ResolvedZone") {
+			t.Errorf("expected %s to fail naming ResolvedZone, got %v", name, err)
+		}
+	}
+	if got := dyn.endpoints(); len(got) != 0 {
+		t.Errorf("expected no record requests, got %v", got)
+	}
+}
+
+func TestBuildLinks(t *testing.T) {
+	tests := []struct {
+		zone, fqdn string
+		record     string
+		zoneLink   string
+	}{
+		{
+			zone: "example.com", fqdn: "_acme-challenge.example.com",
+			record: "TXTRecord/example.com/_acme-challenge.example.com/", zoneLink: "Zone/example.com/",
+		},
+		{
+			zone: "example.com.", fqdn: "_acme-challenge.example.com.",
+			record: "TXTRecord/example.com/_acme-challenge.example.com/", zoneLink: "Zone/example.com/",
+		},
+		{
+			zone: "example.com", fqdn: "_acme-challenge.www.sub.example.com.",
+			record: "TXTRecord/example.com/_acme-challenge.www.sub.example.com/", zoneLink: "Zone/example.com/",
+		},
+		{
+			zone: "sub.example.com.", fqdn: "_acme-challenge.sub.example.com",
+			record: "TXTRecord/sub.example.com/_acme-challenge.sub.example.com/", zoneLink: "Zone/sub.example.com/",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := buildRecordLink(tt.zone, tt.fqdn); got != tt.record {
+			t.Errorf("buildRecordLink(%q, %q) = %q, want %q", tt.zone, tt.fqdn, got, tt.record)
+		}
+		if got := buildZoneLink(tt.zone); got != tt.zoneLink {
+			t.Errorf("buildZoneLink(%q) = %q, want %q", tt.zone, got, tt.zoneLink)
+		}
+	}
+}
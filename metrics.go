@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+// defaultMetricsPort is the port the metrics server listens on unless
+// METRICS_PORT says otherwise.
+const defaultMetricsPort = "9090"
+
+// The solver metrics are labelled by operation and outcome, except where a
+// label would only ever take one value. The present, cleanup and commit
+// counters carry their operation in their name, so they are labelled by
+// outcome only. The Dyn API error counter only counts failures, so it is
+// labelled by the Dyn API operation only, such as "POST TXTRecord". The Dyn
+// API duration histogram carries both labels.
+var (
+	presentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyndns_present_total",
+		Help: "Number of Present calls, by outcome.",
+	}, []string{"outcome"})
+
+	cleanupTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyndns_cleanup_total",
+		Help: "Number of CleanUp calls, by outcome.",
+	}, []string{"outcome"})
+
+	orphanedRecordsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dyndns_orphaned_records_total",
+		Help: "Number of CleanUp calls that found the challenge record but failed to delete it or publish its removal, each of which may have left the record behind.",
+	})
+
+	commitTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyndns_commit_total",
+		Help: "Number of Dyn zone publishes, by outcome.",
+	}, []string{"outcome"})
+
+	dynAPIErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyndns_dyn_api_errors_total",
+		Help: "Number of failed Dyn API requests, by operation.",
+	}, []string{"operation"})
+
+	dynAPIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dyndns_dyn_api_duration_seconds",
+		Help:    "Duration of Dyn API requests, by operation and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "outcome"})
+)
+
+// registerMetrics registers the solver metrics with the default Prometheus
+// registry.
+func registerMetrics() {
+	prometheus.MustRegister(
+		presentTotal,
+		cleanupTotal,
+		orphanedRecordsTotal,
+		commitTotal,
+		dynAPIErrorsTotal,
+		dynAPIDuration,
+	)
+}
+
+// listenAuxiliary binds the port the metrics, readiness and status endpoints
+// are served on, which is METRICS_PORT or defaultMetricsPort.
+func listenAuxiliary() (net.Listener, error) {
+	port := os.Getenv("METRICS_PORT")
+	if port == "" {
+		port = defaultMetricsPort
+	}
+
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for metrics on port %s: %v", port, err)
+	}
+	return l, nil
+}
+
+// startAuxiliary serves the metrics and readiness endpoints in the
+// background and reports whether it could. A port that cannot be bound is
+// logged rather than fatal, since solving challenges matters more than
+// metrics.
+func startAuxiliary(solver *dynDNSProviderSolver) bool {
+	l, err := listenAuxiliary()
+	if err != nil {
+		logError("Metrics and readiness endpoints are disabled", logFields{"error": err})
+		return false
+	}
+	go serveAuxiliary(l, solver)
+	return true
+}
+
+// serveAuxiliary serves the registered metrics on /metrics, the Dyn readiness
+// check of solver on /readyz and its zone activity on /status. It blocks until
+// the server fails.
+func serveAuxiliary(l net.Listener, solver *dynDNSProviderSolver) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/readyz", solver.serveReadyz)
+	mux.HandleFunc("/status", solver.serveStatus)
+
+	klog.Infof("Serving metrics on %s", l.Addr())
+	if err := http.Serve(l, mux); err != nil {
+		klog.Errorf("Error serving metrics: %v", err)
+	}
+}
+
+// outcome returns the outcome label value for an operation that returned err.
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// apiOperation returns the operation label value for a Dyn API request, such
+// as "POST TXTRecord". Only the first path segment of the endpoint is used to
+// keep the label cardinality bounded.
+func apiOperation(method, endpoint string) string {
+	resource := endpoint
+	if i := strings.IndexByte(resource, '/'); i >= 0 {
+		resource = resource[:i]
+	}
+	return method + " " + resource
+}
+
+// observeAPICall records the duration and outcome of a Dyn API request that
+// started at start.
+func observeAPICall(method, endpoint string, start time.Time, err error) {
+	operation := apiOperation(method, endpoint)
+	dynAPIDuration.WithLabelValues(operation, outcome(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dynAPIErrorsTotal.WithLabelValues(operation).Inc()
+	}
+}
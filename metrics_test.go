@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestListenAuxiliaryPortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error splitting address: %v", err)
+	}
+	os.Setenv("METRICS_PORT", port)
+	defer os.Unsetenv("METRICS_PORT")
+
+	if l2, err := listenAuxiliary(); err == nil {
+		l2.Close()
+		t.Error("expected an error for a port that is already in use")
+	}
+}
+
+func TestStartAuxiliaryPortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error splitting address: %v", err)
+	}
+	os.Setenv("METRICS_PORT", port)
+	defer os.Unsetenv("METRICS_PORT")
+
+	var out strings.Builder
+	logJSON, logOutput = true, &out
+	defer func() { logJSON, logOutput = false, os.Stderr }()
+
+	solver := newTestSolver(newFakeDyn())
+	if startAuxiliary(solver) {
+		t.Error("expected the metrics server not to start on a port that is already in use")
+	}
+	var entry map[string]interface{}
+	line := strings.SplitN(out.String(), "\n", 2)[0]
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", line, err)
+	}
+	if entry["level"] != "error" || entry["msg"] != "Metrics and readiness endpoints are disabled" || entry["error"] == nil {
+		t.Errorf("expected the disabled endpoints to be logged as an error, got %q", line)
+	}
+
+	if err := solver.Present(newTestChallenge()); err != nil {
+		t.Errorf("expected the solver to keep serving, got %v", err)
+	}
+}
+
+// TestChartReadinessProbe guards against gating the pod's readiness on the
+// metrics port, which may fail to bind while the webhook itself keeps serving,
+// or on a path that skips the solver's readiness check.
+func TestChartReadinessProbe(t *testing.T) {
+	data, err := os.ReadFile("deploy/cert-manager-webhook-dyndns/templates/deployment.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error reading the chart: %v", err)
+	}
+	i := strings.Index(string(data), "readinessProbe:")
+	if i < 0 {
+		t.Fatal("expected the deployment to define a readinessProbe")
+	}
+	probe := string(data[i:])
+	if j := strings.Index(probe, "volumeMounts:"); j >= 0 {
+		probe = probe[:j]
+	}
+	for _, want := range []string{"scheme: HTTPS", "path: /readyz", "port: https"} {
+		if !strings.Contains(probe, want) {
+			t.Errorf("expected the readinessProbe to use the webhook's /readyz on its https port, got:\n%s", probe)
+			break
+		}
+	}
+}
+
+func TestOutcomeMetrics(t *testing.T) {
+	counters := map[string]func(outcome string) float64{
+		"present": func(outcome string) float64 { return testutil.ToFloat64(presentTotal.WithLabelValues(outcome)) },
+		"cleanup": func(outcome string) float64 { return testutil.ToFloat64(cleanupTotal.WithLabelValues(outcome)) },
+		"commit":  func(outcome string) float64 { return testutil.ToFloat64(commitTotal.WithLabelValues(outcome)) },
+	}
+	snapshot := func() map[string]float64 {
+		values := make(map[string]float64)
+		for name, value := range counters {
+			for _, o := range []string{"success", "error"} {
+				values[name+" "+o] = value(o)
+			}
+		}
+		return values
+	}
+
+	tests := []struct {
+		name     string
+		failures map[string]int
+		want     map[string]float64
+	}{
+		{
+			name: "success",
+			want: map[string]float64{"present success": 1, "cleanup success": 1, "commit success": 2},
+		},
+		{
+			name:     "error",
+			failures: map[string]int{"PUT Zone/example.com/": http.StatusBadRequest},
+			want:     map[string]float64{"present error": 1, "cleanup error": 1, "commit error": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			dyn.failures = tt.failures
+			solver := newTestSolver(dyn)
+
+			before := snapshot()
+			solver.Present(newTestChallenge())
+			solver.CleanUp(newTestChallenge())
+			after := snapshot()
+
+			for key := range before {
+				if got := after[key] - before[key]; got != tt.want[key] {
+					t.Errorf("expected %s to increase by %v, got %v", key, tt.want[key], got)
+				}
+			}
+		})
+	}
+}
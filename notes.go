@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+// commitNotesData holds the fields available to the commit notes template.
+// A batched publish covers several challenges, whose distinct values are
+// joined by ", " in the challenge fields.
+type commitNotesData struct {
+	// Hostname is the hostname of the webhook pod.
+	Hostname string
+	// Zone is the Dyn zone being published.
+	Zone string
+	// FQDN is the name of the challenge record.
+	FQDN string
+	// DNSName is the name the certificate is requested for.
+	DNSName string
+	// Namespace is the namespace of the certificate the challenge is for.
+	Namespace string
+	// UID identifies the challenge request.
+	UID string
+	// Timestamp is the time of the publish in RFC 3339 format.
+	Timestamp string
+}
+
+// commitNotes renders the notes recorded with the zone publish for chs.
+func commitNotes(cfg *dynDNSProviderConfig, chs ...*v1alpha1.ChallengeRequest) (string, error) {
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "unknown-host"
+	}
+	var fqdns, dnsNames, namespaces, uids []string
+	for _, ch := range chs {
+		fqdns = append(fqdns, trimDot(ch.ResolvedFQDN))
+		dnsNames = append(dnsNames, ch.DNSName)
+		namespaces = append(namespaces, ch.ResourceNamespace)
+		uids = append(uids, string(ch.UID))
+	}
+	data := commitNotesData{
+		Hostname:  hostName,
+		Zone:      trimDot(cfg.ZoneName),
+		FQDN:      joinDistinct(fqdns),
+		DNSName:   joinDistinct(dnsNames),
+		Namespace: joinDistinct(namespaces),
+		UID:       joinDistinct(uids),
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+
+	if cfg.CommitNotesTemplate == "" {
+		return fmt.Sprintf("Change by cert-manager-webhook-dyndns@%s, %s on %s for %s in namespace %s, record %s",
+			version,
+			data.Timestamp,
+			data.Hostname,
+			data.DNSName,
+			data.Namespace,
+			data.FQDN,
+		), nil
+	}
+
+	tmpl, err := template.New("notes").Parse(cfg.CommitNotesTemplate)
+	if err != nil {
+		return "", err
+	}
+	var notes strings.Builder
+	if err := tmpl.Execute(&notes, data); err != nil {
+		return "", err
+	}
+	return notes.String(), nil
+}
+
+// joinDistinct joins the distinct values, in the order they first appear.
+func joinDistinct(values []string) string {
+	var distinct []string
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			distinct = append(distinct, v)
+		}
+	}
+	return strings.Join(distinct, ", ")
+}
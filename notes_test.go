@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommitNotesTemplate(t *testing.T) {
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"commitNotesTemplate": "challenge {{.FQDN}} in {{.Zone}} for {{.Namespace}}/{{.DNSName}}",
+	})
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	notes, err := commitNotes(&cfg, ch)
+	if err != nil {
+		t.Fatalf("unexpected error rendering notes: %v", err)
+	}
+	if want := "challenge _acme-challenge.example.com in example.com for default/example.com"; notes != want {
+		t.Errorf("unexpected notes\ngot:  %s\nwant: %s", notes, want)
+	}
+
+	cfg.CommitNotesTemplate = "{{.Unknown"
+	if err := (&dynDNSProviderSolver{}).validate(&cfg); err == nil {
+		t.Error("expected an invalid template to fail validation")
+	}
+}
+
+func TestDefaultCommitNotes(t *testing.T) {
+	cfg, err := loadConfig(newTestChallenge().Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	notes, err := commitNotes(&cfg, newTestChallenge())
+	if err != nil {
+		t.Fatalf("unexpected error rendering notes: %v", err)
+	}
+	if !strings.Contains(notes, "cert-manager-webhook-dyndns@"+version) {
+		t.Errorf("expected the notes to identify the webhook and its version, got %q", notes)
+	}
+	if !strings.HasSuffix(notes, "for example.com in namespace default, record _acme-challenge.example.com") {
+		t.Errorf("expected the notes to identify the certificate, got %q", notes)
+	}
+	if strings.Contains(notes, "external-dns") {
+		t.Errorf("expected the notes not to mention external-dns, got %q", notes)
+	}
+}
+
+func TestBatchedCommitNotes(t *testing.T) {
+	cfg, err := loadConfig(newTestChallenge().Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	www := newTestChallenge()
+	www.DNSName = "www.example.com"
+	www.ResolvedFQDN = "_acme-challenge.www.example.com"
+
+	notes, err := commitNotes(&cfg, newTestChallenge(), www, newTestChallenge())
+	if err != nil {
+		t.Fatalf("unexpected error rendering notes: %v", err)
+	}
+	if !strings.HasSuffix(notes, "for example.com, www.example.com in namespace default, record _acme-challenge.example.com, _acme-challenge.www.example.com") {
+		t.Errorf("expected the notes to identify every certificate once, got %q", notes)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultSessionWaitTimeout bounds waiting for a pooled Dyn session when no
+// timeout is configured.
+const defaultSessionWaitTimeout = 30 * time.Second
+
+// sessionWaitTimeout returns how long to wait for a pooled Dyn session.
+func (cfg *dynDNSProviderConfig) sessionWaitTimeout() time.Duration {
+	if cfg.SessionWaitTimeout.Duration == 0 {
+		return defaultSessionWaitTimeout
+	}
+	return cfg.SessionWaitTimeout.Duration
+}
+
+// sessionPool hands out the Dyn sessions of one account, each to a single
+// Present or CleanUp at a time, so that no more than size sessions of the
+// account exist. Sessions are logged in lazily by dynClient and kept idle
+// between uses, so that consecutive challenges share a login. Idle sessions
+// are only reused for the same sessionKey, since configs reading the
+// credentials from another namespace or secret, or creating sessions with
+// another transport, must not share one. An idle session of another key is
+// destroyed to make room when the pool is full. Idle sessions are also
+// destroyed once they expire or when the webhook shuts down.
+type sessionPool struct {
+	// slots holds a token for every session of the account, in use or idle.
+	slots chan struct{}
+
+	mu   sync.Mutex
+	idle map[string][]*dynSession
+	// released is closed and replaced whenever a session is released, to
+	// wake the calls waiting for one.
+	released chan struct{}
+}
+
+func newSessionPool(size int) *sessionPool {
+	return &sessionPool{
+		slots:    make(chan struct{}, size),
+		idle:     make(map[string][]*dynSession),
+		released: make(chan struct{}),
+	}
+}
+
+// acquire returns a session of the pool for key, waiting up to timeout for
+// one to be released if all of them are in use.
+func (p *sessionPool) acquire(key string, timeout time.Duration) (*dynSession, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s, evicted, released := p.tryAcquire(key)
+		for _, e := range evicted {
+			logout(e.client, e.path)
+		}
+		if s != nil {
+			return s, true
+		}
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return nil, false
+		}
+	}
+}
+
+// tryAcquire returns an idle session for key, or a new session if the pool
+// has room for one, along with the idle sessions to destroy. If no session
+// can be handed out, it returns the channel closed by the next release.
+func (p *sessionPool) tryAcquire(key string) (*dynSession, []*dynSession, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var evicted []*dynSession
+	for k, idle := range p.idle {
+		live := idle[:0]
+		for _, s := range idle {
+			if time.Now().Before(s.expires) {
+				live = append(live, s)
+				continue
+			}
+			evicted = append(evicted, s)
+			<-p.slots
+		}
+		p.idle[k] = live
+		if len(live) == 0 {
+			delete(p.idle, k)
+		}
+	}
+
+	if idle := p.idle[key]; len(idle) > 0 {
+		s := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		if len(p.idle[key]) == 0 {
+			delete(p.idle, key)
+		}
+		return s, evicted, nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return &dynSession{}, evicted, nil
+	default:
+	}
+
+	// Make room by destroying an idle session of another key, handing its
+	// slot to the new session.
+	for k, idle := range p.idle {
+		evicted = append(evicted, idle[len(idle)-1])
+		p.idle[k] = idle[:len(idle)-1]
+		if len(p.idle[k]) == 0 {
+			delete(p.idle, k)
+		}
+		return &dynSession{}, evicted, nil
+	}
+	return nil, evicted, p.released
+}
+
+// release returns s, which was acquired for key, to the pool, keeping it idle
+// for the next acquire. A session that is not logged in frees its slot.
+func (p *sessionPool) release(key string, s *dynSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s.client != nil {
+		p.idle[key] = append(p.idle[key], s)
+	} else {
+		<-p.slots
+	}
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// drain removes and returns the idle sessions of the pool.
+func (p *sessionPool) drain() []*dynSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var idle []*dynSession
+	for _, sessions := range p.idle {
+		for _, s := range sessions {
+			idle = append(idle, s)
+			<-p.slots
+		}
+	}
+	p.idle = make(map[string][]*dynSession)
+	return idle
+}
+
+// accountKey identifies the Dyn account of cfg, whose sessions share a pool.
+func accountKey(cfg *dynDNSProviderConfig) string {
+	account, _ := json.Marshal([]interface{}{cfg.APIEndpoint, cfg.CustomerName, cfg.Username})
+	return string(account)
+}
+
+// pool returns the session pool of cfg's account, if one was created.
+func (c *dynDNSProviderSolver) pool(cfg *dynDNSProviderConfig) *sessionPool {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	return c.pools[accountKey(cfg)]
+}
+
+// acquireSession hands the calling Present or CleanUp a session of the pool
+// for cfg's account. Pools are keyed by accountKey, so that the sessions of
+// all configs using an account count towards its limit, and idle sessions
+// are reused by sessionKey. The pool is created with cfg.MaxSessions
+// sessions by the first call for its account.
+func (c *dynDNSProviderSolver) acquireSession(cfg *dynDNSProviderConfig) error {
+	account := accountKey(cfg)
+	c.sessionsMu.Lock()
+	pool, ok := c.pools[account]
+	if !ok {
+		pool = newSessionPool(cfg.MaxSessions)
+		if c.pools == nil {
+			c.pools = make(map[string]*sessionPool)
+		}
+		c.pools[account] = pool
+	}
+	c.sessionsMu.Unlock()
+
+	s, ok := pool.acquire(sessionKey(cfg), cfg.sessionWaitTimeout())
+	if !ok {
+		return fmt.Errorf("timed out after %v waiting for one of the %d Dyn sessions of %s", cfg.sessionWaitTimeout(), cap(pool.slots), cfg.Username)
+	}
+	cfg.session = s
+	return nil
+}
+
+// releaseSession returns the session of cfg to its pool. The session stays
+// logged in until it expires, makes room for another session of the account
+// or closeSessions destroys it.
+func (c *dynDNSProviderSolver) releaseSession(cfg *dynDNSProviderConfig) {
+	c.pool(cfg).release(sessionKey(cfg), cfg.session)
+	cfg.session = nil
+}
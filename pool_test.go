@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+func TestSessionPool(t *testing.T) {
+	const maxSessions = 2
+
+	dyn := newFakeDyn()
+	var mu sync.Mutex
+	var live, peak, logins int
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/REST/Session" {
+			mu.Lock()
+			switch r.Method {
+			case "POST":
+				logins++
+				live++
+				if live > peak {
+					peak = live
+				}
+			case "DELETE":
+				live--
+			}
+			mu.Unlock()
+		}
+		if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/REST/TXTRecord/") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{"maxSessions": maxSessions})
+		ch.Key = fmt.Sprintf("challenge-key-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- solver.Present(ch)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error presenting: %v", err)
+		}
+	}
+	if peak > maxSessions {
+		t.Errorf("expected at most %d sessions at once, got %d", maxSessions, peak)
+	}
+	if logins > cap(errs) {
+		t.Errorf("expected at most one login per challenge, got %d", logins)
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != cap(errs) {
+		t.Errorf("expected %d records, got %q", cap(errs), got)
+	}
+
+	solver.closeSessions()
+	if live != 0 {
+		t.Errorf("expected all sessions to be destroyed on shutdown, %d are left", live)
+	}
+}
+
+func TestSessionPoolKeepsIdleSessions(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+
+	for i := 0; i < 2; i++ {
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{"maxSessions": 2})
+		ch.Key = fmt.Sprintf("challenge-key-%d", i)
+		if err := solver.Present(ch); err != nil {
+			t.Fatalf("unexpected error presenting: %v", err)
+		}
+	}
+	if got := len(dyn.sent("POST Session")); got != 1 {
+		t.Errorf("expected a single login for sequential challenges, got %d", got)
+	}
+	if got := len(dyn.sent("DELETE Session")); got != 0 {
+		t.Errorf("expected the idle session to be kept, got %d logouts", got)
+	}
+
+	solver.closeSessions()
+	if got := len(dyn.sent("DELETE Session")); got != 1 {
+		t.Errorf("expected the idle session to be destroyed on shutdown, got %d logouts", got)
+	}
+}
+
+func TestSessionPoolKeys(t *testing.T) {
+	solver := newTestSolver(newFakeDyn())
+	base, err := loadConfig(withConfig(t, newTestChallenge(), map[string]interface{}{"maxSessions": 1}).Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	base.namespace = "default"
+
+	accounts := map[string]func(cfg *dynDNSProviderConfig){
+		"username":     func(cfg *dynDNSProviderConfig) { cfg.Username = "other-user" },
+		"customerName": func(cfg *dynDNSProviderConfig) { cfg.CustomerName = "other-customer" },
+		"apiEndpoint":  func(cfg *dynDNSProviderConfig) { cfg.APIEndpoint = "https://dyn.example.com/REST" },
+	}
+	credentials := map[string]func(cfg *dynDNSProviderConfig){
+		"namespace":   func(cfg *dynDNSProviderConfig) { cfg.namespace = "other" },
+		"secret":      func(cfg *dynDNSProviderConfig) { cfg.PasswordSecretRef.Name = "other-password" },
+		"client cert": func(cfg *dynDNSProviderConfig) { cfg.ClientCertSecretRef.Name = "dyndns-client-cert" },
+		"proxy":       func(cfg *dynDNSProviderConfig) { cfg.ProxyURL = "http://proxy.example.com:3128" },
+		"sessionPath": func(cfg *dynDNSProviderConfig) { cfg.SessionPath = "Gateway/Session" },
+	}
+	held := base
+	if err := solver.beginSession(&held); err != nil {
+		t.Fatalf("unexpected error acquiring a session: %v", err)
+	}
+	defer solver.endSession(&held)
+	for name, vary := range accounts {
+		t.Run(name, func(t *testing.T) {
+			cfg := base
+			cfg.SessionWaitTimeout = duration{10 * time.Millisecond}
+			vary(&cfg)
+			if err := solver.beginSession(&cfg); err != nil {
+				t.Fatalf("expected a session of another account's pool, got %v", err)
+			}
+			solver.endSession(&cfg)
+		})
+	}
+	for name, vary := range credentials {
+		t.Run(name, func(t *testing.T) {
+			cfg := base
+			cfg.SessionWaitTimeout = duration{10 * time.Millisecond}
+			vary(&cfg)
+			if err := solver.beginSession(&cfg); err == nil {
+				solver.endSession(&cfg)
+				t.Fatal("expected the account's only session to be in use")
+			}
+		})
+	}
+	if got := len(solver.pools); got != len(accounts)+1 {
+		t.Errorf("expected %d pools, got %d", len(accounts)+1, got)
+	}
+}
+
+func TestSessionPoolSharedAccount(t *testing.T) {
+	dyn := newFakeDyn()
+	var mu sync.Mutex
+	var live, peak int
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/REST/Session" {
+			mu.Lock()
+			switch r.Method {
+			case "POST":
+				live++
+				if live > peak {
+					peak = live
+				}
+			case "DELETE":
+				live--
+			}
+			mu.Unlock()
+		}
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+	issuers := []*v1alpha1.ChallengeRequest{
+		withConfig(t, newTestChallenge(), map[string]interface{}{"maxSessions": 1, "requestTimeout": "10s", "sessionWaitTimeout": "10ms"}),
+		withConfig(t, newTestChallenge(), map[string]interface{}{"maxSessions": 1, "requestTimeout": "20s", "sessionWaitTimeout": "10ms"}),
+	}
+
+	held, err := loadConfig(issuers[0].Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	held.namespace = "default"
+	if err := solver.beginSession(&held); err != nil {
+		t.Fatalf("unexpected error acquiring a session: %v", err)
+	}
+	if err := solver.Present(issuers[1]); err == nil {
+		t.Error("expected the other issuer of the account to wait for its only session")
+	}
+	unpooled := withConfig(t, newTestChallenge(), map[string]interface{}{"sessionWaitTimeout": "10ms"})
+	if err := solver.Present(unpooled); err == nil {
+		t.Error("expected an issuer of the account without maxSessions to wait for its only session")
+	}
+	solver.endSession(&held)
+
+	for _, ch := range issuers {
+		if err := solver.Present(ch); err != nil {
+			t.Fatalf("unexpected error presenting: %v", err)
+		}
+	}
+	if peak > 1 {
+		t.Errorf("expected at most 1 session of the account at once, got %d", peak)
+	}
+	if got := len(dyn.sent("DELETE Session")); got != 1 {
+		t.Errorf("expected the idle session of the first issuer to make room, got %d logouts", got)
+	}
+}
+
+func TestSessionPoolTimeout(t *testing.T) {
+	solver := newTestSolver(newFakeDyn())
+	cfg, err := loadConfig(withConfig(t, newTestChallenge(), map[string]interface{}{
+		"maxSessions":        1,
+		"sessionWaitTimeout": "10ms",
+	}).Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	held := cfg
+	if err := solver.beginSession(&held); err != nil {
+		t.Fatalf("unexpected error acquiring a session: %v", err)
+	}
+	waiting := cfg
+	if err := solver.beginSession(&waiting); err == nil {
+		t.Error("expected an error waiting for a session while the pool is exhausted")
+	}
+
+	solver.endSession(&held)
+	if err := solver.beginSession(&waiting); err != nil {
+		t.Errorf("expected a released session to be handed out, got %v", err)
+	}
+	solver.endSession(&waiting)
+}
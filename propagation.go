@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/nesv/go-dynect/dynect"
+)
+
+// defaultPropagationCheckInterval is the delay between propagation checks
+// when no interval is configured.
+const defaultPropagationCheckInterval = time.Second
+
+// defaultConfirmPublishTimeout bounds waiting for a zone publish to be
+// confirmed when no timeout is configured.
+const defaultConfirmPublishTimeout = 30 * time.Second
+
+// confirmPublishTimeout returns how long to wait for a zone publish to be
+// confirmed.
+func (cfg *dynDNSProviderConfig) confirmPublishTimeout() time.Duration {
+	if cfg.ConfirmPublishTimeout.Duration == 0 {
+		return defaultConfirmPublishTimeout
+	}
+	return cfg.ConfirmPublishTimeout.Duration
+}
+
+// propagationJitter is the fraction by which the propagation delay is
+// randomly lengthened or shortened, so that challenges presented together
+// during mass renewals do not all wait and return in lockstep.
+const propagationJitter = 0.2
+
+// propagationCheckInterval returns the delay between propagation checks.
+func (cfg *dynDNSProviderConfig) propagationCheckInterval() time.Duration {
+	if cfg.PropagationCheckInterval.Duration == 0 {
+		return defaultPropagationCheckInterval
+	}
+	return cfg.PropagationCheckInterval.Duration
+}
+
+// waitForPropagation waits for the challenge record published under link to
+// become visible. Unless propagation checks are configured, it waits for the
+// propagation delay. Otherwise it returns as soon as the record is present,
+// or fails once the configured checks are exhausted.
+func (c *dynDNSProviderSolver) waitForPropagation(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest, link string) error {
+	fields := cfg.logFields(logFields{"zone": cfg.ZoneName, "fqdn": ch.ResolvedFQDN, "operation": "present"})
+
+	if cfg.PropagationCheckRetries == 0 {
+		if c.skipPropagationDelay {
+			logDebug("Propagation delay disabled, not waiting", fields)
+			return nil
+		}
+		delay := c.jitter(cfg.propagationDelay())
+		fields["duration"] = delay
+		logDebug("Waiting for the record to propagate", fields)
+		return c.sleep(delay)
+	}
+
+	for attempt := 0; ; attempt++ {
+		found, err := c.findTXTRecord(cfg, ch.ResourceNamespace, link, ch.Key)
+		if err != nil {
+			return err
+		}
+		if found != "" {
+			logDebug("Record is present", fields)
+			return nil
+		}
+		if attempt >= cfg.PropagationCheckRetries {
+			return fmt.Errorf("dyndns TXT record %s is not present after %d checks", link, attempt+1)
+		}
+
+		delay := cfg.propagationCheckInterval()
+		fields["duration"] = delay
+		logDebug("Record is not present yet, checking again", fields)
+		if err := c.sleep(delay); err != nil {
+			return err
+		}
+	}
+}
+
+// zoneSerial returns the serial of the zone of cfg.
+func (c *dynDNSProviderSolver) zoneSerial(cfg *dynDNSProviderConfig, namespace string) (int, error) {
+	var zone dynect.ZoneResponse
+	if err := c.doRequest(cfg, namespace, "GET", buildZoneLink(cfg.ZoneName), nil, &zone); err != nil {
+		return 0, err
+	}
+	return zone.Data.Serial, nil
+}
+
+// confirmPublish waits until the serial of the zone of cfg has increased past
+// serial, its value before the publish, which shows the publish is live.
+func (c *dynDNSProviderSolver) confirmPublish(cfg *dynDNSProviderConfig, namespace string, serial int) error {
+	fields := cfg.logFields(logFields{"zone": cfg.ZoneName, "operation": "commit"})
+	deadline := time.Now().Add(cfg.confirmPublishTimeout())
+	for {
+		current, err := c.zoneSerial(cfg, namespace)
+		if err != nil {
+			return err
+		}
+		if current > serial {
+			fields["serial"] = current
+			logDebug("Zone publish confirmed", fields)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("dyndns zone %s serial is still %d %v after publishing", cfg.ZoneName, current, cfg.confirmPublishTimeout())
+		}
+
+		delay := cfg.propagationCheckInterval()
+		fields["duration"] = delay
+		logDebug("Zone publish not live yet, checking again", fields)
+		if err := c.sleep(delay); err != nil {
+			return err
+		}
+	}
+}
+
+// jitter returns d randomly adjusted by up to propagationJitter either way.
+func (c *dynDNSProviderSolver) jitter(d time.Duration) time.Duration {
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(float64(d) * (1 + propagationJitter*(2*c.rand.Float64()-1)))
+}
+
+// errStopping is returned when waiting is cancelled because the webhook is
+// shutting down.
+var errStopping = errors.New("dyndns webhook is shutting down")
+
+// sleep waits for d, or until the webhook shuts down.
+func (c *dynDNSProviderSolver) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.stopCh:
+		return errStopping
+	}
+}
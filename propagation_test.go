@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	mathrand "math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerifyBeforeCommit(t *testing.T) {
+	t.Run("visible record is published", func(t *testing.T) {
+		dyn := newFakeDyn()
+		solver := newTestSolver(dyn)
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{"verifyBeforeCommit": true})
+
+		if err := solver.Present(ch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if dyn.publishes != 1 {
+			t.Errorf("expected 1 publish, got %d", dyn.publishes)
+		}
+	})
+
+	t.Run("missing record is not published", func(t *testing.T) {
+		dyn := newFakeDyn()
+		dyn.failures = map[string]int{"GET " + testRecordsLink: http.StatusNotFound}
+		solver := newTestSolver(dyn)
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{"verifyBeforeCommit": true})
+
+		if err := solver.Present(ch); err == nil {
+			t.Fatal("expected an error for a record that is not visible")
+		}
+		for _, endpoint := range dyn.endpoints() {
+			if endpoint == "PUT Zone/example.com/" {
+				t.Error("expected the zone not to be published")
+			}
+		}
+	})
+}
+
+func TestConfirmPublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		live    bool
+		wantErr bool
+	}{
+		{name: "serial increased", live: true},
+		{name: "serial unchanged", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method == "PUT" && !tt.live {
+					return dyn.respond(http.StatusOK, map[string]interface{}{})
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"confirmPublish":           true,
+				"confirmPublishTimeout":    "20ms",
+				"propagationCheckInterval": "5ms",
+			})
+
+			err := solver.Present(ch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPropagationChecks(t *testing.T) {
+	tests := []struct {
+		name    string
+		hidden  int
+		wantErr bool
+	}{
+		{name: "record appears", hidden: 3},
+		{name: "record never appears", hidden: 5, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			// Hide the record from the first lookups, as if it took a while
+			// to become visible after being published. The first lookup
+			// checks for an existing record.
+			hidden := tt.hidden
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method == "GET" && r.URL.Path == "/REST/"+testRecordsLink && hidden > 0 {
+					hidden--
+					return dyn.respond(http.StatusNotFound, nil)
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"propagationDelay":         "1h",
+				"propagationCheckRetries":  3,
+				"propagationCheckInterval": "1ms",
+			})
+
+			err := solver.Present(ch)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPropagationDelayJitter(t *testing.T) {
+	a := &dynDNSProviderSolver{rand: mathrand.New(mathrand.NewSource(1))}
+	b := &dynDNSProviderSolver{rand: mathrand.New(mathrand.NewSource(1))}
+
+	delay := defaultPropagationDelay
+	min := time.Duration(float64(delay) * (1 - propagationJitter))
+	max := time.Duration(float64(delay) * (1 + propagationJitter))
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		got := a.jitter(delay)
+		if got < min || got > max {
+			t.Errorf("expected a delay between %v and %v, got %v", min, max, got)
+		}
+		if same := b.jitter(delay); same != got {
+			t.Errorf("expected the same seed to give the same delay, got %v and %v", got, same)
+		}
+		distinct[got] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("expected the delay to vary, got %v", distinct)
+	}
+}
+
+func TestShutdownCancelsPropagationDelay(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	stopCh := make(chan struct{})
+	solver.stopCh = stopCh
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"propagationDelay": "1h"})
+
+	done := make(chan error)
+	go func() { done <- solver.Present(ch) }()
+	close(stopCh)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errStopping) {
+			t.Errorf("expected Present to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Present to return when the webhook shuts down")
+	}
+}
+
+func TestSkipPropagationDelay(t *testing.T) {
+	solver := newTestSolver(newFakeDyn())
+	solver.skipPropagationDelay = true
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{"propagationDelay": "1h"})
+
+	done := make(chan error)
+	go func() { done <- solver.Present(ch) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error presenting: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Present not to wait for the propagation delay")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterKey returns the key of the limiter for cfg, which is shared by
+// the Dyn clients of all configs for the same customer account.
+func rateLimiterKey(cfg *dynDNSProviderConfig) string {
+	account, _ := json.Marshal([]string{cfg.APIEndpoint, cfg.CustomerName})
+	return string(account)
+}
+
+// rateLimiter returns the limiter shared by the Dyn clients of the customer
+// account of cfg, limited to cfg.RequestsPerSecond, or nil if cfg does not
+// limit requests.
+func (c *dynDNSProviderSolver) rateLimiter(cfg *dynDNSProviderConfig) *rate.Limiter {
+	if cfg.RequestsPerSecond <= 0 {
+		return nil
+	}
+
+	limit := rate.Limit(cfg.RequestsPerSecond)
+	key := rateLimiterKey(cfg)
+	c.limitersMu.Lock()
+	defer c.limitersMu.Unlock()
+	limiter, ok := c.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(limit, 1)
+		if c.limiters == nil {
+			c.limiters = make(map[string]*rate.Limiter)
+		}
+		c.limiters[key] = limiter
+	} else if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+	}
+	return limiter
+}
+
+// rateLimitedClient delays every request of the wrapped client until the
+// limiter allows it, giving up once the request timeout has passed.
+type rateLimitedClient struct {
+	dynClientInterface
+	limiter *rate.Limiter
+	timeout time.Duration
+}
+
+func (c rateLimitedClient) Do(method, endpoint string, requestData, responseData interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return c.dynClientInterface.Do(method, endpoint, requestData, responseData)
+}
+
+// defaultRetryAfter is how long a request rate limited by Dyn is delayed
+// before it is retried when the response does not say.
+const defaultRetryAfter = time.Second
+
+// retryAfterTransport retries requests Dyn rejects with 429 Too Many Requests
+// once the delay given by their Retry-After header has passed. The 429
+// response is returned as is once the retries are exhausted, or if the delay
+// would outlast the deadline of the request.
+type retryAfterTransport struct {
+	retries int
+	next    http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= t.retries {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		delay := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if deadline, ok := req.Context().Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		logInfo("Dyn API rate limit reached, retrying", logFields{
+			"operation": req.Method + " " + req.URL.Path,
+			"duration":  delay,
+		})
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryAfter returns the delay requested by a Retry-After header value, which
+// is either a number of seconds or an HTTP date, or defaultRetryAfter if the
+// value is missing or invalid.
+func retryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestsPerSecond(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	ch := newTestChallenge()
+	withConfig(t, ch, map[string]interface{}{"requestsPerSecond": 50})
+
+	start := time.Now()
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Logging in, looking up, creating, publishing and logging out are five
+	// requests, of which only the first may be made without waiting.
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("expected requests to be limited to 50 per second, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterPerAccount(t *testing.T) {
+	solver := &dynDNSProviderSolver{}
+	cfg := func(customer string) *dynDNSProviderConfig {
+		return &dynDNSProviderConfig{APIEndpoint: "https://api.dynect.net", CustomerName: customer, RequestsPerSecond: 1}
+	}
+
+	first := solver.rateLimiter(cfg("customer"))
+	if got := solver.rateLimiter(cfg("customer")); got != first {
+		t.Error("expected configs for the same account to share a limiter")
+	}
+	if got := solver.rateLimiter(cfg("other")); got == first {
+		t.Error("expected configs for another account not to share a limiter")
+	}
+	if !first.Allow() || !solver.rateLimiter(cfg("other")).Allow() {
+		t.Error("expected each account to be limited on its own")
+	}
+	if got := solver.rateLimiter(&dynDNSProviderConfig{CustomerName: "customer"}); got != nil {
+		t.Errorf("expected no limiter without requestsPerSecond, got %v", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "3", want: 3 * time.Second},
+		{value: "0", want: 0},
+		{value: "Fri, 01 Jan 2021 12:00:05 GMT", want: 5 * time.Second},
+		{value: "Fri, 01 Jan 2021 11:59:00 GMT", want: 0},
+		{value: "", want: defaultRetryAfter},
+		{value: "soon", want: defaultRetryAfter},
+	}
+
+	for _, tt := range tests {
+		if got := retryAfter(tt.value, now); got != tt.want {
+			t.Errorf("retryAfter(%q): expected %v, got %v", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestRateLimitedResponses(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		wantErr    bool
+	}{
+		{name: "retried after the delay", retryAfter: "0"},
+		{name: "delay beyond the request timeout", retryAfter: "120", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			limited := false
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/REST/TXTRecord/") && !limited {
+					limited = true
+					resp, err := dyn.respond(http.StatusTooManyRequests, nil)
+					resp.Header.Set("Retry-After", tt.retryAfter)
+					return resp, err
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{"requestTimeout": "5s"})
+
+			err := solver.Present(ch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); tt.wantErr == (len(got) == 1) {
+				t.Errorf("unexpected records %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultMaxRetries is how often a transient Dyn API failure is retried
+	// when the config does not say otherwise.
+	defaultMaxRetries = 3
+	// defaultRetryBaseDelay is the delay before the first retry when the
+	// config does not say otherwise.
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	// defaultPublishRetries is how often a zone publish blocked by another
+	// operation is retried when the config does not say otherwise.
+	defaultPublishRetries = 5
+	// defaultLoginRetries is how often a transient failure to create a Dyn
+	// session is retried when the config does not say otherwise.
+	defaultLoginRetries = 2
+)
+
+// maxRetries returns how often a transient Dyn API failure is retried.
+func (cfg *dynDNSProviderConfig) maxRetries() int {
+	switch {
+	case cfg.MaxRetries < 0:
+		return 0
+	case cfg.MaxRetries == 0:
+		return defaultMaxRetries
+	}
+	return cfg.MaxRetries
+}
+
+// publishRetries returns how often a zone publish blocked by another
+// operation in progress is retried.
+func (cfg *dynDNSProviderConfig) publishRetries() int {
+	switch {
+	case cfg.PublishRetries < 0:
+		return 0
+	case cfg.PublishRetries == 0:
+		return defaultPublishRetries
+	}
+	return cfg.PublishRetries
+}
+
+// loginRetries returns how often a transient failure to create a Dyn session
+// is retried.
+func (cfg *dynDNSProviderConfig) loginRetries() int {
+	switch {
+	case cfg.LoginRetries < 0:
+		return 0
+	case cfg.LoginRetries == 0:
+		return defaultLoginRetries
+	}
+	return cfg.LoginRetries
+}
+
+// retryBaseDelay returns the delay before the first retry.
+func (cfg *dynDNSProviderConfig) retryBaseDelay() time.Duration {
+	if cfg.RetryBaseDelay.Duration == 0 {
+		return defaultRetryBaseDelay
+	}
+	return cfg.RetryBaseDelay.Duration
+}
+
+// withRetries calls fn, retrying it with exponential backoff and jitter for as
+// long as it fails with a transient error and cfg allows further attempts.
+// POST requests are not retried, since a POST that reached Dyn but lost its
+// response would create a duplicate record. A Present retried by
+// cert-manager finds the record instead.
+func (c *dynDNSProviderSolver) withRetries(cfg *dynDNSProviderConfig, method, endpoint string, fn func() error) error {
+	if method == "POST" {
+		return fn()
+	}
+	return c.retryTransient(cfg.maxRetries(), cfg.retryBaseDelay(), method, endpoint, fn)
+}
+
+// retryTransient calls fn, retrying it up to retries times with exponential
+// backoff from base for as long as it fails with a transient error. Waiting
+// between attempts stops when the webhook shuts down, returning the last
+// error.
+func (c *dynDNSProviderSolver) retryTransient(retries int, base time.Duration, method, endpoint string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !isTransient(err) || attempt >= retries {
+			return err
+		}
+
+		delay := backoff(base, attempt)
+		klog.Infof("Dyn request %s %s failed, retrying in %v: %v", method, endpoint, delay, err)
+		if c.sleep(delay) != nil {
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before retry number attempt, starting at base and
+// doubling with every attempt. Half of the delay is randomised so that
+// concurrent retries spread out.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
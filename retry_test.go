@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		code         int
+		failures     int
+		loginRetries int
+		wantLogins   int
+		wantErr      bool
+	}{
+		{name: "transient failures", code: http.StatusServiceUnavailable, failures: 2, wantLogins: 3},
+		{name: "too many transient failures", code: http.StatusServiceUnavailable, failures: 2, loginRetries: 1, wantLogins: 2, wantErr: true},
+		{name: "retries disabled", code: http.StatusServiceUnavailable, failures: 1, loginRetries: -1, wantLogins: 1, wantErr: true},
+		{name: "rejected credentials", code: http.StatusBadRequest, failures: 1, wantLogins: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			logins := 0
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method == "POST" && r.URL.Path == "/REST/Session" {
+					logins++
+					if logins <= tt.failures {
+						return dyn.respond(tt.code, nil)
+					}
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"loginRetries":   tt.loginRetries,
+				"retryBaseDelay": "1ms",
+			})
+
+			err := solver.Present(ch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if logins != tt.wantLogins {
+				t.Errorf("expected %d logins, got %d", tt.wantLogins, logins)
+			}
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		status       int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{name: "server error is retried", method: "GET", status: http.StatusServiceUnavailable, wantAttempts: 2},
+		{name: "client error fails fast", method: "GET", status: http.StatusBadRequest, wantErr: true, wantAttempts: 1},
+		{name: "create is not retried", method: "POST", status: http.StatusServiceUnavailable, wantErr: true, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			attempts := 0
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method == tt.method && strings.HasPrefix(r.URL.Path, "/REST/TXTRecord/") {
+					attempts++
+					if attempts == 1 {
+						return dyn.respond(tt.status, nil)
+					}
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"retryBaseDelay": "1ms",
+			})
+			err := solver.Present(ch)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("expected %d %s attempts, got %d", tt.wantAttempts, tt.method, attempts)
+			}
+		})
+	}
+}
+
+func TestPublishRetriesOperationInProgress(t *testing.T) {
+	const blocked = `{"status": "failure", "msgs": [{"INFO": "publish: Operation blocked by current task", "ERR_CD": "OPERATION_FAILED"}]}`
+	tests := []struct {
+		name          string
+		body          string
+		blocked       int
+		wantErr       bool
+		wantPublishes int
+	}{
+		{name: "operation in progress is retried", body: blocked, blocked: 2, wantPublishes: 3},
+		{name: "retries are limited", body: blocked, blocked: 5, wantErr: true, wantPublishes: 3},
+		{name: "other errors are not retried", body: "invalid", blocked: 1, wantErr: true, wantPublishes: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			remaining := tt.blocked
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/REST/Zone/") && remaining > 0 {
+					remaining--
+					return dyn.respondJSON(http.StatusBadRequest, tt.body), nil
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"publishRetries": 2,
+				"retryBaseDelay": "1ms",
+			})
+			cfg, err := loadConfig(ch.Config)
+			if err != nil {
+				t.Fatalf("unexpected error loading config: %v", err)
+			}
+
+			err = commit(solver, &cfg, ch)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got := len(dyn.endpoints()); got != tt.wantPublishes {
+				t.Errorf("expected %d publishes, got %d", tt.wantPublishes, got)
+			}
+		})
+	}
+}
+
+func TestShutdownCancelsRetries(t *testing.T) {
+	const blocked = `{"status": "failure", "msgs": [{"INFO": "publish: Operation blocked by current task", "ERR_CD": "OPERATION_FAILED"}]}`
+	tests := []struct {
+		name   string
+		method string
+		prefix string
+		body   string
+		status int
+	}{
+		{name: "transient failure", method: "GET", prefix: "/REST/TXTRecord/", status: http.StatusServiceUnavailable},
+		{name: "operation in progress", method: "PUT", prefix: "/REST/Zone/", body: blocked, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			attempts := 0
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				if r.Method == tt.method && strings.HasPrefix(r.URL.Path, tt.prefix) {
+					attempts++
+					return dyn.respondJSON(tt.status, tt.body), nil
+				}
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+			stopCh := make(chan struct{})
+			solver.stopCh = stopCh
+			close(stopCh)
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"retryBaseDelay": "1h",
+			})
+
+			done := make(chan error)
+			go func() { done <- solver.Present(ch) }()
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("expected the failure to be returned")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected retrying to stop when the webhook shuts down")
+			}
+			if attempts != 1 {
+				t.Errorf("expected 1 %s attempt, got %d", tt.method, attempts)
+			}
+		})
+	}
+}
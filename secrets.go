@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// secretCacheTTL is how long a secret read from the API server is served from
+// the cache before it is read again, so that rotated credentials are picked
+// up soon.
+const secretCacheTTL = 30 * time.Second
+
+// secretCache serves the secrets referenced by solver configs for a short
+// while after reading them, so that the several lookups of a challenge do not
+// each require a request to the API server. Only the referenced secrets are
+// read, with a plain get, so the webhook needs neither list nor watch access
+// to secrets, and holds no others in memory.
+type secretCache struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedSecret
+}
+
+// cachedSecret is a secret together with the time it is read again after.
+type cachedSecret struct {
+	secret  *corev1.Secret
+	expires time.Time
+}
+
+// newSecretCache returns a cache reading secrets through client.
+func newSecretCache(client kubernetes.Interface) *secretCache {
+	return &secretCache{
+		client:  client,
+		ttl:     secretCacheTTL,
+		entries: make(map[string]cachedSecret),
+	}
+}
+
+// get returns the named secret from the cache, reading it from the API server
+// if it is not cached or its entry expired.
+func (s *secretCache) get(namespace, name string) (*corev1.Secret, error) {
+	key := namespace + "/" + name
+	s.mu.Lock()
+	if e, ok := s.entries[key]; ok && time.Now().Before(e.expires) {
+		s.mu.Unlock()
+		return e.secret, nil
+	}
+	s.mu.Unlock()
+
+	sec, err := s.client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	s.entries[key] = cachedSecret{secret: sec, expires: now.Add(s.ttl)}
+	return sec, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretCache(t *testing.T) {
+	solver := newTestSolver(nil)
+	solver.secrets = newSecretCache(solver.client)
+
+	ref := cmmeta.SecretKeySelector{
+		LocalObjectReference: cmmeta.LocalObjectReference{Name: "dyndns-password"},
+		Key:                  "password",
+	}
+	got, err := solver.secretValue("default", ref)
+	if err != nil {
+		t.Fatalf("unexpected error reading secret: %v", err)
+	}
+	if got != "secret" {
+		t.Errorf("expected the password, got %q", got)
+	}
+
+	// The cached secret is served until its entry expires.
+	solver.secrets.client = fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "dyndns-password", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("rotated")},
+	})
+	if got, _ := solver.secretValue("default", ref); got != "secret" {
+		t.Errorf("expected the password from the cache, got %q", got)
+	}
+	solver.secrets.mu.Lock()
+	for key, e := range solver.secrets.entries {
+		e.expires = time.Now()
+		solver.secrets.entries[key] = e
+	}
+	solver.secrets.mu.Unlock()
+	if got, _ := solver.secretValue("default", ref); got != "rotated" {
+		t.Errorf("expected the rotated password once the entry expired, got %q", got)
+	}
+
+	ref.Name = "missing"
+	if _, err := solver.secretValue("default", ref); err == nil {
+		t.Error("expected an error for a missing secret")
+	}
+}
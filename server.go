@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"runtime"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/component-base/logs"
+
+	"github.com/jetstack/cert-manager/cmd/util"
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/cmd/server"
+	logf "github.com/jetstack/cert-manager/pkg/logs"
+)
+
+// runWebhookServer serves solver under groupName like cert-manager's
+// cmd.RunWebhookServer, and adds the solver's readiness to the /readyz
+// endpoint of the webhook's secure port, so that the pod's readiness probe
+// does not depend on the metrics port being bound.
+func runWebhookServer(groupName string, solver *dynDNSProviderSolver) {
+	stopCh, exit := util.SetupExitHandler(util.GracefulShutdown)
+	defer exit() // This function might call os.Exit, so defer last
+
+	logs.InitLogs()
+	defer logs.FlushLogs()
+
+	if len(os.Getenv("GOMAXPROCS")) == 0 {
+		runtime.GOMAXPROCS(runtime.NumCPU())
+	}
+
+	o := server.NewWebhookServerOptions(os.Stdout, os.Stderr, groupName, solver)
+	command := &cobra.Command{
+		Short: "Launch an ACME solver API server",
+		Long:  "Launch an ACME solver API server",
+		RunE: func(c *cobra.Command, args []string) error {
+			config, err := o.Config()
+			if err != nil {
+				return err
+			}
+			srv, err := config.Complete().New()
+			if err != nil {
+				return err
+			}
+			if err := srv.GenericAPIServer.AddReadyzChecks(solver.readyzCheck()); err != nil {
+				return err
+			}
+			return srv.GenericAPIServer.PrepareRun().Run(stopCh)
+		},
+	}
+	o.RecommendedOptions.AddFlags(command.Flags())
+	command.Flags().AddGoFlagSet(flag.CommandLine)
+
+	if err := command.Execute(); err != nil {
+		logf.Log.Error(err, "error executing command")
+		util.SetExitCode(err)
+	}
+}
+
+// readyzCheck returns the solver's readiness as a check of the webhook's
+// /readyz endpoint.
+func (c *dynDNSProviderSolver) readyzCheck() healthz.HealthChecker {
+	return healthz.NamedCheck("dyndns", func(*http.Request) error {
+		return c.ready()
+	})
+}
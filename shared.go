@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/nesv/go-dynect/dynect"
+)
+
+// sharedRecordTTL is how long a challenge presented at a shared record name
+// is tracked without being presented again or cleaned up. Past it, the
+// challenge is assumed to be gone without a CleanUp reaching the webhook, so
+// that it no longer defers the publish of the others.
+const sharedRecordTTL = time.Hour
+
+// sharedRecord tracks the challenges presented at one record name when
+// SharedRecordCleanup is set.
+type sharedRecord struct {
+	// keys holds the keys of the challenges presented but not cleaned up,
+	// with when they were last presented.
+	keys map[string]time.Time
+	// deferred holds the keys of the challenges cleaned up while others
+	// were still presented, whose deletions are published by the last one.
+	deferred []string
+	// updated is when the record name was last presented or cleaned up.
+	updated time.Time
+}
+
+// expireSharedRecords drops the challenges presented more than
+// sharedRecordTTL before now, and the record names nothing happened at since.
+// It must be called with sharedMu held.
+func (c *dynDNSProviderSolver) expireSharedRecords(now time.Time) {
+	for name, r := range c.sharedRecords {
+		for key, presented := range r.keys {
+			if now.Sub(presented) > sharedRecordTTL {
+				delete(r.keys, key)
+			}
+		}
+		if len(r.keys) == 0 && now.Sub(r.updated) > sharedRecordTTL {
+			delete(c.sharedRecords, name)
+		}
+	}
+}
+
+// sharedRecordName returns the key under which the challenges presented at
+// the record name of ch are tracked.
+func sharedRecordName(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) string {
+	return sessionKey(cfg) + "/" + buildRecordLink(cfg.ZoneName, ch.ResolvedFQDN)
+}
+
+// retainSharedRecord records ch as presented at its record name.
+func (c *dynDNSProviderSolver) retainSharedRecord(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) {
+	name := sharedRecordName(cfg, ch)
+	now := time.Now()
+	c.sharedMu.Lock()
+	defer c.sharedMu.Unlock()
+	c.expireSharedRecords(now)
+	r, ok := c.sharedRecords[name]
+	if !ok {
+		r = &sharedRecord{keys: make(map[string]time.Time)}
+		if c.sharedRecords == nil {
+			c.sharedRecords = make(map[string]*sharedRecord)
+		}
+		c.sharedRecords[name] = r
+	}
+	r.keys[ch.Key], r.updated = now, now
+}
+
+// forgetSharedRecord drops ch from the challenges presented at its record
+// name without deferring anything, for a Present that failed.
+func (c *dynDNSProviderSolver) forgetSharedRecord(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest) {
+	name := sharedRecordName(cfg, ch)
+	c.sharedMu.Lock()
+	defer c.sharedMu.Unlock()
+	r, ok := c.sharedRecords[name]
+	if !ok {
+		return
+	}
+	delete(r.keys, ch.Key)
+	if len(r.keys) == 0 && len(r.deferred) == 0 {
+		delete(c.sharedRecords, name)
+	}
+}
+
+// releaseSharedRecord drops ch from the challenges presented at its record
+// name, after CleanUp deleted its record if deleted is set. While other
+// challenges are presented there, the publish is deferred to the last of
+// them, and it reports false. The last one deletes the records of the
+// deferred challenges again, in case their deletions were staged in a
+// session that has ended since, and reports whether there is anything to
+// publish.
+func (c *dynDNSProviderSolver) releaseSharedRecord(cfg *dynDNSProviderConfig, ch *v1alpha1.ChallengeRequest, deleted bool, fields logFields) (bool, error) {
+	name := sharedRecordName(cfg, ch)
+	now := time.Now()
+	c.sharedMu.Lock()
+	c.expireSharedRecords(now)
+	r, ok := c.sharedRecords[name]
+	if ok {
+		delete(r.keys, ch.Key)
+	}
+	if ok && len(r.keys) > 0 {
+		r.deferred, r.updated = append(r.deferred, ch.Key), now
+		c.sharedMu.Unlock()
+		logVerbose("Other challenges are presented at the record name, deferring the publish", fields)
+		return false, nil
+	}
+	var deferred []string
+	if ok {
+		deferred = r.deferred
+		delete(c.sharedRecords, name)
+	}
+	c.sharedMu.Unlock()
+
+	link := buildRecordLink(cfg.ZoneName, ch.ResolvedFQDN)
+	for i, key := range deferred {
+		recordLink, err := c.findTXTRecord(cfg, ch.ResourceNamespace, link, key)
+		if err == nil && recordLink != "" {
+			err = c.doRequest(cfg, ch.ResourceNamespace, "DELETE", recordLink, nil, &dynect.RecordResponse{})
+		}
+		if err != nil {
+			c.deferSharedRecords(name, deferred[i:])
+			return false, err
+		}
+	}
+	return deleted || len(deferred) > 0, nil
+}
+
+// deferSharedRecords hands the deletions of keys that failed back to the
+// challenges at the record name, so that the next CleanUp there retries them.
+func (c *dynDNSProviderSolver) deferSharedRecords(name string, keys []string) {
+	c.sharedMu.Lock()
+	defer c.sharedMu.Unlock()
+	r, ok := c.sharedRecords[name]
+	if !ok {
+		r = &sharedRecord{keys: make(map[string]time.Time)}
+		if c.sharedRecords == nil {
+			c.sharedRecords = make(map[string]*sharedRecord)
+		}
+		c.sharedRecords[name] = r
+	}
+	r.deferred, r.updated = append(r.deferred, keys...), time.Now()
+}
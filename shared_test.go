@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+func TestSharedRecordCleanup(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	keys := []string{"key-a", "key-b", "key-c"}
+	challenge := func(key string) *v1alpha1.ChallengeRequest {
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{"sharedRecordCleanup": true})
+		ch.Key = key
+		return ch
+	}
+	run := func(fn func(*v1alpha1.ChallengeRequest) error, keys ...string) {
+		var wg sync.WaitGroup
+		errs := make(chan error, len(keys))
+		for _, key := range keys {
+			ch := challenge(key)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- fn(ch)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	publishes := func() int {
+		dyn.mu.Lock()
+		defer dyn.mu.Unlock()
+		return dyn.publishes
+	}
+
+	run(solver.Present, keys...)
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 3 {
+		t.Fatalf("expected records for all keys, got %v", got)
+	}
+	presented := publishes()
+
+	run(solver.CleanUp, "key-a", "key-b")
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 || got[0] != `"key-c"` {
+		t.Errorf("expected only the record of key-c to be left, got %v", got)
+	}
+	if got := publishes(); got != presented {
+		t.Errorf("expected no publish while key-c is presented, got %d", got-presented)
+	}
+
+	// Simulate the staged deletion of key-a being lost with its session.
+	dyn.mu.Lock()
+	dyn.records[testRecordsLink+"100"] = `"key-a"`
+	dyn.mu.Unlock()
+
+	run(solver.CleanUp, "key-c")
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 0 {
+		t.Errorf("expected all records to be deleted, got %v", got)
+	}
+	if got := publishes(); got != presented+1 {
+		t.Errorf("expected a single publish by the last cleanup, got %d", got-presented)
+	}
+	if len(solver.sharedRecords) != 0 {
+		t.Errorf("expected no record names to be tracked, got %v", solver.sharedRecords)
+	}
+}
+
+func TestSharedRecordExpiry(t *testing.T) {
+	dyn := newFakeDyn()
+	solver := newTestSolver(dyn)
+	challenge := func(key string) *v1alpha1.ChallengeRequest {
+		ch := withConfig(t, newTestChallenge(), map[string]interface{}{"sharedRecordCleanup": true})
+		ch.Key = key
+		return ch
+	}
+	for _, key := range []string{"key-a", "key-b"} {
+		if err := solver.Present(challenge(key)); err != nil {
+			t.Fatalf("unexpected error presenting %s: %v", key, err)
+		}
+	}
+
+	// Simulate key-a never being cleaned up.
+	expired := time.Now().Add(-2 * sharedRecordTTL)
+	solver.sharedMu.Lock()
+	for _, r := range solver.sharedRecords {
+		r.keys["key-a"] = expired
+	}
+	solver.sharedMu.Unlock()
+
+	presented := dyn.publishes
+	if err := solver.CleanUp(challenge("key-b")); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+	if dyn.publishes != presented+1 {
+		t.Errorf("expected an expired challenge not to defer the publish, got %d publishes", dyn.publishes-presented)
+	}
+	if len(solver.sharedRecords) != 0 {
+		t.Errorf("expected no record names to be tracked, got %v", solver.sharedRecords)
+	}
+
+	solver.sharedRecords = map[string]*sharedRecord{
+		"stale": {keys: map[string]time.Time{}, deferred: []string{"key-c"}, updated: expired},
+	}
+	if err := solver.Present(challenge("key-d")); err != nil {
+		t.Fatalf("unexpected error presenting key-d: %v", err)
+	}
+	if _, ok := solver.sharedRecords["stale"]; ok {
+		t.Error("expected a stale record name to be dropped")
+	}
+}
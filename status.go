@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// zoneActivity records when the solver last published each zone.
+type zoneActivity struct {
+	mu        sync.Mutex
+	published map[string]time.Time
+}
+
+// record notes that zone was published at t.
+func (a *zoneActivity) record(zone string, t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.published == nil {
+		a.published = make(map[string]time.Time)
+	}
+	a.published[trimDot(zone)] = t
+}
+
+// snapshot returns a copy of the last publish time of every zone.
+func (a *zoneActivity) snapshot() map[string]time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	published := make(map[string]time.Time, len(a.published))
+	for zone, t := range a.published {
+		published[zone] = t
+	}
+	return published
+}
+
+// statusResponse is the body of the /status endpoint.
+type statusResponse struct {
+	Version string `json:"version"`
+	// LastPublished holds the time of the last successful publish by the
+	// webhook of every zone it published since it started.
+	LastPublished map[string]time.Time `json:"lastPublished"`
+}
+
+// serveStatus reports the activity of the solver per zone as JSON.
+func (c *dynDNSProviderSolver) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statusResponse{
+		Version:       version,
+		LastPublished: c.activity.snapshot(),
+	})
+}
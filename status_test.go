@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	solver := newTestSolver(newFakeDyn())
+	status := func() statusResponse {
+		rec := httptest.NewRecorder()
+		solver.serveStatus(rec, httptest.NewRequest("GET", "/status", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		var resp statusResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("unexpected error decoding status: %v", err)
+		}
+		return resp
+	}
+
+	if got := status().LastPublished; len(got) != 0 {
+		t.Errorf("expected no zones before any publish, got %v", got)
+	}
+
+	before := time.Now()
+	if err := solver.Present(newTestChallenge()); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+	resp := status()
+	published, ok := resp.LastPublished["example.com"]
+	if !ok || published.Before(before.Truncate(time.Second)) {
+		t.Errorf("expected example.com to be published after %v, got %v", before, resp.LastPublished)
+	}
+	if resp.Version != version {
+		t.Errorf("expected version %q, got %q", version, resp.Version)
+	}
+}
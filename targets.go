@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+)
+
+// dynTarget is a Dyn account and zone the challenge record is written to.
+// Fields left empty are taken from the rest of the solver config, except that
+// a target setting any credential field replaces all of them.
+type dynTarget struct {
+	Username             string                      `json:"username"`
+	UsernameSecretRef    cmmeta.SecretKeySelector    `json:"usernameSecretRef"`
+	PasswordSecretRef    cmmeta.SecretKeySelector    `json:"passwordSecretRef"`
+	CredentialsSecretRef cmmeta.LocalObjectReference `json:"credentialsSecretRef"`
+	CustomerName         string                      `json:"customerName"`
+	ZoneName             string                      `json:"zonename"`
+	APIEndpoint          string                      `json:"apiEndpoint"`
+}
+
+// hasCredentials reports whether t sets any of the credential fields.
+func (t *dynTarget) hasCredentials() bool {
+	return t.Username != "" || t.UsernameSecretRef.Name != "" || t.PasswordSecretRef.Name != "" || t.CredentialsSecretRef.Name != ""
+}
+
+// targetConfigs returns the config of every target of cfg, or cfg itself if
+// it has no targets.
+func (cfg *dynDNSProviderConfig) targetConfigs() []dynDNSProviderConfig {
+	if len(cfg.Targets) == 0 {
+		return []dynDNSProviderConfig{*cfg}
+	}
+
+	configs := make([]dynDNSProviderConfig, 0, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		tc := *cfg
+		if t.hasCredentials() {
+			tc.Username = t.Username
+			tc.UsernameSecretRef = t.UsernameSecretRef
+			tc.UsernameFile = ""
+			tc.PasswordSecretRef = t.PasswordSecretRef
+			tc.PasswordFile = ""
+			tc.CredentialsSecretRef = t.CredentialsSecretRef
+		}
+		if t.CustomerName != "" {
+			tc.CustomerName = t.CustomerName
+		}
+		if t.ZoneName != "" {
+			tc.ZoneName = t.ZoneName
+		}
+		if t.APIEndpoint != "" {
+			tc.APIEndpoint = t.APIEndpoint
+		}
+		configs = append(configs, tc)
+	}
+	return configs
+}
+
+// targetQuorum returns how many targets of cfg the challenge has to succeed
+// for.
+func (cfg *dynDNSProviderConfig) targetQuorum() int {
+	if cfg.TargetQuorum == 0 || cfg.TargetQuorum > len(cfg.Targets) {
+		return len(cfg.Targets)
+	}
+	return cfg.TargetQuorum
+}
+
+// forEachTarget calls fn with the config of every target of cfg at once. It
+// fails with a TargetsError if fn fails for more targets than the quorum
+// allows. Without targets, fn is called with cfg and its error is returned as
+// is.
+func (c *dynDNSProviderSolver) forEachTarget(cfg *dynDNSProviderConfig, fn func(cfg dynDNSProviderConfig) error) error {
+	configs := cfg.targetConfigs()
+	if len(cfg.Targets) == 0 {
+		return fn(configs[0])
+	}
+
+	errs := make([]error, len(configs))
+	var wg sync.WaitGroup
+	for i := range configs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(configs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("target %d (customer %s): %w", i, configs[i].CustomerName, err))
+		}
+	}
+	if len(configs)-len(failed) < cfg.targetQuorum() {
+		return &TargetsError{Total: len(configs), Quorum: cfg.targetQuorum(), Errors: failed}
+	}
+	for _, err := range failed {
+		logError("Challenge failed for a target, but succeeded for the quorum", cfg.logFields(logFields{"error": err}))
+	}
+	return nil
+}
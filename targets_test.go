@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTargets(t *testing.T) {
+	tests := []struct {
+		name     string
+		quorum   int
+		failures map[string]int
+		wantErr  bool
+		want     map[string]int
+	}{
+		{name: "all succeed", want: map[string]int{"a": 1, "b": 1}},
+		{
+			name:     "one fails",
+			failures: map[string]int{"b": http.StatusBadRequest},
+			wantErr:  true,
+			want:     map[string]int{"a": 1, "b": 0},
+		},
+		{
+			name:     "one fails within the quorum",
+			quorum:   1,
+			failures: map[string]int{"b": http.StatusBadRequest},
+			want:     map[string]int{"a": 1, "b": 0},
+		},
+		{
+			name:     "all fail",
+			quorum:   1,
+			failures: map[string]int{"a": http.StatusBadRequest, "b": http.StatusBadRequest},
+			wantErr:  true,
+			want:     map[string]int{"a": 0, "b": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyns := map[string]*fakeDyn{"a": newFakeDyn(), "b": newFakeDyn()}
+			var targets []map[string]interface{}
+			for _, name := range []string{"a", "b"} {
+				if code, ok := tt.failures[name]; ok {
+					dyns[name].failures = map[string]int{"POST " + testRecordsLink: code}
+				}
+				server := httptest.NewServer(dyns[name])
+				defer server.Close()
+				targets = append(targets, map[string]interface{}{
+					"apiEndpoint":  server.URL + "/REST",
+					"customerName": "customer-" + name,
+				})
+			}
+			solver := newTestSolver(nil)
+
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"targets":      targets,
+				"targetQuorum": tt.quorum,
+			})
+			err := solver.Present(ch)
+			if tt.wantErr {
+				var targetsErr *TargetsError
+				if !errors.As(err, &targetsErr) {
+					t.Fatalf("expected a TargetsError, got %v", err)
+				}
+				if len(targetsErr.Errors) != len(tt.failures) {
+					t.Errorf("expected %d failed targets, got %v", len(tt.failures), targetsErr.Errors)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error presenting: %v", err)
+			}
+			for name, want := range tt.want {
+				if got := dyns[name].txtValues("example.com", "_acme-challenge.example.com"); len(got) != want {
+					t.Errorf("expected %d records at target %s, got %v", want, name, got)
+				}
+			}
+
+			if err := solver.CleanUp(ch); err != nil {
+				t.Fatalf("unexpected error cleaning up: %v", err)
+			}
+			for name := range tt.want {
+				if got := dyns[name].txtValues("example.com", "_acme-challenge.example.com"); len(got) != 0 {
+					t.Errorf("expected the record at target %s to be deleted, got %v", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTargetConfigs(t *testing.T) {
+	cfg, err := loadConfig(withConfig(t, newTestChallenge(), map[string]interface{}{
+		"usernameSecretRef": map[string]string{"name": "dyndns-password", "key": "username"},
+		"targets": []map[string]interface{}{
+			{"zonename": "example.org"},
+			{"username": "user-b", "passwordSecretRef": map[string]string{"name": "dyndns-b", "key": "password"}},
+		},
+	}).Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	configs := cfg.targetConfigs()
+	if len(configs) != 2 {
+		t.Fatalf("expected 2 target configs, got %d", len(configs))
+	}
+	if c := configs[0]; c.ZoneName != "example.org" || c.UsernameSecretRef.Name != "dyndns-password" || c.CustomerName != cfg.CustomerName {
+		t.Errorf("expected the first target to inherit the credentials, got %+v", c)
+	}
+	if c := configs[1]; c.Username != "user-b" || c.UsernameSecretRef.Name != "" || c.PasswordSecretRef.Name != "dyndns-b" || c.ZoneName != cfg.ZoneName {
+		t.Errorf("expected the second target to replace the credentials, got %+v", c)
+	}
+}
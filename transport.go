@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/nesv/go-dynect/dynect"
+)
+
+// dynAPIPath is the path component of the default Dyn API base URL, which is
+// replaced when requests are redirected to a configured API endpoint.
+const dynAPIPath = "/REST"
+
+// endpointTransport sends requests that go-dynect addresses to the default Dyn
+// API base URL to an alternate base URL instead. go-dynect does not allow the
+// base URL to be changed, so this is done at the transport level.
+type endpointTransport struct {
+	base *url.URL
+	next http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.Scheme = t.base.Scheme
+	u.Host = t.base.Host
+	u.Path = strings.TrimSuffix(t.base.Path, "/") + strings.TrimPrefix(req.URL.Path, dynAPIPath)
+
+	r := new(http.Request)
+	*r = *req
+	r.URL = &u
+	r.Host = ""
+
+	return t.next.RoundTrip(r)
+}
+
+// headerTransport adds static headers to every request, without replacing
+// the headers go-dynect sets itself.
+type headerTransport struct {
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = req.Header.Clone()
+	for name, value := range t.headers {
+		if r.Header.Get(name) == "" {
+			r.Header.Set(name, value)
+		}
+	}
+
+	return t.next.RoundTrip(r)
+}
+
+// userAgent returns the User-Agent identifying the webhook, its version and
+// the cluster it runs in to Dyn.
+func (c *dynDNSProviderSolver) userAgent() string {
+	ua := "cert-manager-webhook-dyndns/" + version
+	if c.clusterID != "" {
+		ua += " (" + c.clusterID + ")"
+	}
+	return ua
+}
+
+// contextTransport makes every request with the context of the operation it
+// belongs to, since go-dynect creates its requests without one.
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(t.ctx))
+}
+
+// Connection pooling defaults of the Dyn API transport.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// idleConns returns the connection pooling settings of the Dyn API transport.
+func (cfg *dynDNSProviderConfig) idleConns() (maxIdle, maxIdlePerHost int, timeout time.Duration) {
+	maxIdle, maxIdlePerHost, timeout = cfg.MaxIdleConns, cfg.MaxIdleConnsPerHost, cfg.IdleConnTimeout.Duration
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+	if maxIdlePerHost == 0 {
+		maxIdlePerHost = defaultMaxIdleConnsPerHost
+	}
+	if timeout == 0 {
+		timeout = defaultIdleConnTimeout
+	}
+	return maxIdle, maxIdlePerHost, timeout
+}
+
+// cachedTransport is an HTTP transport shared by the configs with the same
+// settings.
+type cachedTransport struct {
+	*http.Transport
+	// clientTLSHash identifies the client certificate the transport
+	// presents, if any.
+	clientTLSHash string
+}
+
+// httpTransport returns the HTTP transport connecting to Dyn for cfg. It is
+// shared by all configs with the same settings and client certificate
+// secret, so that their connections are reused. Once the contents of the
+// secret change, the transport is replaced and its idle connections, which
+// present the old certificate, are closed.
+func (c *dynDNSProviderSolver) httpTransport(cfg *dynDNSProviderConfig) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	maxIdle, maxIdlePerHost, idleTimeout := cfg.idleConns()
+	newTransport := func() *http.Transport {
+		return &http.Transport{
+			Proxy:               proxy,
+			DialContext:         dialContext(cfg.DialNetwork),
+			TLSClientConfig:     cfg.clientTLS,
+			MaxIdleConns:        maxIdle,
+			MaxIdleConnsPerHost: maxIdlePerHost,
+			IdleConnTimeout:     idleTimeout,
+		}
+	}
+
+	key := fmt.Sprintf("%s|%s|%d|%d|%v|%s", cfg.ProxyURL, cfg.DialNetwork, maxIdle, maxIdlePerHost, idleTimeout, cfg.clientTLSSecret)
+	c.transportsMu.Lock()
+	defer c.transportsMu.Unlock()
+	if t, ok := c.transports[key]; ok {
+		if t.clientTLSHash == cfg.clientTLSHash {
+			return t.Transport, nil
+		}
+		t.CloseIdleConnections()
+	}
+	if c.transports == nil {
+		c.transports = make(map[string]*cachedTransport)
+	}
+	t := &cachedTransport{Transport: newTransport(), clientTLSHash: cfg.clientTLSHash}
+	c.transports[key] = t
+	return t.Transport, nil
+}
+
+// dynTransport returns the HTTP transport Dyn clients for cfg should use.
+func (c *dynDNSProviderSolver) dynTransport(cfg *dynDNSProviderConfig) (http.RoundTripper, error) {
+	var transport http.RoundTripper = c.transport
+	if transport == nil {
+		t, err := c.httpTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+
+	if cfg.APIEndpoint != "" {
+		base, err := url.Parse(cfg.APIEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		transport = &endpointTransport{base: base, next: transport}
+	}
+
+	headers := map[string]string{"User-Agent": c.userAgent()}
+	for name, value := range cfg.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	transport = &headerTransport{headers: headers, next: transport}
+
+	// Requests rate limited by Dyn are retried within the request timeout.
+	transport = &retryAfterTransport{retries: cfg.maxRetries(), next: transport}
+	if breaker := c.circuitBreaker(cfg); breaker != nil {
+		transport = &circuitBreakerTransport{breaker: breaker, next: transport}
+	}
+
+	return transport, nil
+}
+
+// dialContext returns a dial function connecting on network instead of the
+// TCP network requested, or on the requested network if network is empty.
+func dialContext(network string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if network == "" {
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// newDynectClient returns a go-dynect client for cfg that is not yet logged
+// in. It is the default implementation of dynDNSProviderSolver.newDynClient.
+func (c *dynDNSProviderSolver) newDynectClient(cfg *dynDNSProviderConfig) (dynClientInterface, error) {
+	transport, err := c.dynTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dynClient := dynect.NewClient(cfg.CustomerName)
+	dynClient.SetTransport(transport)
+
+	return dynectClient{Client: dynClient, timeout: cfg.operationTimeout}, nil
+}
+
+// Keys of the secret selected by clientCertSecretRef.
+const (
+	clientCertKey = "tls.crt"
+	clientKeyKey  = "tls.key"
+	clientCAKey   = "ca.crt"
+)
+
+// loadClientTLS loads the TLS client certificate selected by
+// clientCertSecretRef, if any, into the TLS config of cfg.
+func (c *dynDNSProviderSolver) loadClientTLS(cfg *dynDNSProviderConfig, namespace string) error {
+	name := cfg.ClientCertSecretRef.Name
+	if name == "" {
+		return nil
+	}
+	ref := func(key string) cmmeta.SecretKeySelector {
+		return cmmeta.SecretKeySelector{LocalObjectReference: cmmeta.LocalObjectReference{Name: name}, Key: key}
+	}
+
+	certPEM, err := c.secretValue(namespace, ref(clientCertKey))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := c.secretValue(namespace, ref(clientKeyKey))
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return fmt.Errorf("dyndns clientCertSecretRef %s/%s holds an invalid key pair: %v", namespace, name, err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	caPEM, err := c.secretValue(namespace, ref(clientCAKey))
+	if _, missing := err.(*SecretKeyNotFoundError); err != nil && !missing {
+		return err
+	}
+	if caPEM != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM([]byte(caPEM)) {
+			return fmt.Errorf("dyndns clientCertSecretRef %s/%s holds no valid CA certificate", namespace, name)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	hash := sha256.New()
+	for _, value := range []string{certPEM, keyPEM, caPEM} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	cfg.clientTLS = tlsConfig
+	cfg.clientTLSSecret = namespace + "/" + name
+	cfg.clientTLSHash = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
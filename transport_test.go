@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAPIEndpointOverride(t *testing.T) {
+	dyn := newFakeDyn()
+	var hosts []string
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Scheme+"://"+r.URL.Host)
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"apiEndpoint": "http://dyn.internal:8080/REST",
+	})
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+
+	for _, host := range hosts {
+		if host != "http://dyn.internal:8080" {
+			t.Errorf("expected request to the configured endpoint, got %s", host)
+		}
+	}
+	if got := dyn.txtValues("example.com", "_acme-challenge.example.com"); len(got) != 1 {
+		t.Errorf("expected the record to be created through the endpoint, got %v", got)
+	}
+}
+
+func TestDialNetwork(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		network string
+		wantErr bool
+	}{
+		{network: ""},
+		{network: "tcp"},
+		{network: "tcp4"},
+		{network: "tcp6", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		conn, err := dialContext(tt.network)(context.Background(), "tcp", l.Addr().String())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("dialing an IPv4 address on %q: got error %v, want error %t", tt.network, err, tt.wantErr)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	cfg, err := loadConfig(newTestChallenge().Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	cfg.DialNetwork = "udp"
+	if err := (&dynDNSProviderSolver{}).validate(&cfg); err == nil {
+		t.Error("expected an error for a dial network other than tcp")
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	dyn := newFakeDyn()
+	var hosts []string
+	var auth []string
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		auth = append(auth, r.Header.Get("Proxy-Authorization"))
+		return nil, nil
+	}
+	proxy := httptest.NewServer(dyn)
+	defer proxy.Close()
+
+	solver := newTestSolver(nil)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"apiEndpoint": "http://dyn.internal/REST",
+		"proxyURL":    strings.Replace(proxy.URL, "http://", "http://proxy-user:proxy-pass@", 1),
+	})
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+
+	if len(hosts) == 0 {
+		t.Fatal("expected requests to go through the proxy")
+	}
+	for i, host := range hosts {
+		if host != "dyn.internal" {
+			t.Errorf("expected a proxied request to dyn.internal, got %s", host)
+		}
+		if auth[i] == "" {
+			t.Error("expected the proxy credentials to be sent")
+		}
+	}
+}
+
+func TestMockDynServer(t *testing.T) {
+	const (
+		session = "Session"
+		records = "TXTRecord/example.com/_acme-challenge.example.com/"
+		record  = records + "1"
+		zone    = "Zone/example.com/"
+	)
+
+	tests := []struct {
+		name         string
+		failures     map[string]int
+		wantErr      bool
+		wantRequests []string
+	}{
+		{
+			name: "present and clean up",
+			wantRequests: []string{
+				"POST " + session, "GET " + records, "POST " + records, "PUT " + zone, "DELETE " + session,
+				"POST " + session, "GET " + records, "GET " + record, "DELETE " + record, "PUT " + zone, "DELETE " + session,
+			},
+		},
+		{
+			name:         "failed login",
+			failures:     map[string]int{"POST " + session: http.StatusBadRequest},
+			wantErr:      true,
+			wantRequests: []string{"POST " + session},
+		},
+		{
+			name:         "record create failure",
+			failures:     map[string]int{"POST " + records: http.StatusBadRequest},
+			wantErr:      true,
+			wantRequests: []string{"POST " + session, "GET " + records, "POST " + records, "DELETE " + session},
+		},
+		{
+			name:         "publish failure",
+			failures:     map[string]int{"PUT " + zone: http.StatusBadRequest},
+			wantErr:      true,
+			wantRequests: []string{"POST " + session, "GET " + records, "POST " + records, "PUT " + zone, "DELETE " + session},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			dyn.failures = tt.failures
+			server := httptest.NewServer(dyn)
+			defer server.Close()
+
+			solver := newTestSolver(nil)
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+				"apiEndpoint": server.URL + "/REST",
+			})
+
+			err := solver.Present(ch)
+			if err == nil {
+				err = solver.CleanUp(ch)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			dyn.mu.Lock()
+			defer dyn.mu.Unlock()
+			if got := strings.Join(dyn.requests, "\n"); got != strings.Join(tt.wantRequests, "\n") {
+				t.Errorf("expected requests\n%s\ngot\n%s", strings.Join(tt.wantRequests, "\n"), got)
+			}
+		})
+	}
+}
+
+func TestTransportReuse(t *testing.T) {
+	dyn := newFakeDyn()
+	var mu sync.Mutex
+	var conns int
+	server := httptest.NewUnstartedServer(dyn)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	solver := newTestSolver(nil)
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"apiEndpoint":     server.URL + "/REST",
+		"idleConnTimeout": "30s",
+	})
+	for i := 0; i < 2; i++ {
+		if err := solver.Present(ch); err != nil {
+			t.Fatalf("unexpected error presenting: %v", err)
+		}
+		if err := solver.CleanUp(ch); err != nil {
+			t.Fatalf("unexpected error cleaning up: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("expected a single connection to be reused across sessions, got %d", conns)
+	}
+
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	first, err := solver.httpTransport(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error creating the transport: %v", err)
+	}
+	second, err := solver.httpTransport(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error creating the transport: %v", err)
+	}
+	if first != second {
+		t.Error("expected the transport to be reused")
+	}
+	if first.MaxIdleConns != defaultMaxIdleConns || first.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost || first.IdleConnTimeout != 30*time.Second {
+		t.Errorf("unexpected connection pooling settings %d, %d, %v", first.MaxIdleConns, first.MaxIdleConnsPerHost, first.IdleConnTimeout)
+	}
+}
+
+// newTestKeyPair returns a PEM encoded self-signed certificate and its key.
+func newTestKeyPair(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cert-manager-webhook-dyndns"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error encoding key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestClientCertificate(t *testing.T) {
+	dyn := newFakeDyn()
+	var clientCerts []int
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		clientCerts = append(clientCerts, len(r.TLS.PeerCertificates))
+		return nil, nil
+	}
+	server := httptest.NewUnstartedServer(dyn)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	certPEM, keyPEM := newTestKeyPair(t)
+	solver := newTestSolver(nil)
+	solver.client = fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "dyndns-password", Namespace: "default"},
+			Data:       map[string][]byte{"password": []byte("secret")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "dyndns-client-cert", Namespace: "default"},
+			Data: map[string][]byte{
+				"tls.crt": certPEM,
+				"tls.key": keyPEM,
+				"ca.crt":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+			},
+		},
+	)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"apiEndpoint":         server.URL + "/REST",
+		"clientCertSecretRef": map[string]string{"name": "dyndns-client-cert"},
+	})
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+
+	if len(clientCerts) == 0 {
+		t.Fatal("expected requests to the Dyn API")
+	}
+	for _, n := range clientCerts {
+		if n != 1 {
+			t.Errorf("expected the client certificate to be presented, got %d certificates", n)
+		}
+	}
+}
+
+func TestClientCertificateTransports(t *testing.T) {
+	solver := &dynDNSProviderSolver{}
+	cfg := func(secret, hash string) *dynDNSProviderConfig {
+		return &dynDNSProviderConfig{clientTLS: &tls.Config{}, clientTLSSecret: secret, clientTLSHash: hash}
+	}
+	transport := func(cfg *dynDNSProviderConfig) *http.Transport {
+		t.Helper()
+		tr, err := solver.httpTransport(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return tr
+	}
+
+	first := transport(cfg("default/dyndns-client-cert", "a"))
+	if transport(cfg("default/dyndns-client-cert", "a")) != first {
+		t.Error("expected the transport of an unchanged client certificate to be reused")
+	}
+	if transport(cfg("other/dyndns-client-cert", "a")) == first {
+		t.Error("expected the client certificate of another namespace to get its own transport")
+	}
+	rotated := transport(cfg("default/dyndns-client-cert", "b"))
+	if rotated == first {
+		t.Error("expected a rotated client certificate to get a new transport")
+	}
+	if transport(cfg("default/dyndns-client-cert", "b")) != rotated {
+		t.Error("expected the transport of the rotated client certificate to be reused")
+	}
+	if len(solver.transports) != 2 {
+		t.Errorf("expected a transport per client certificate secret, got %d", len(solver.transports))
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	dyn := newFakeDyn()
+	var sources, contentTypes []string
+	dyn.handle = func(r *http.Request) (*http.Response, error) {
+		sources = append(sources, r.Header.Get("X-Request-Source"))
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		return nil, nil
+	}
+	solver := newTestSolver(dyn)
+
+	ch := withConfig(t, newTestChallenge(), map[string]interface{}{
+		"headers": map[string]string{
+			"X-Request-Source": "cluster-a",
+			"Content-Type":     "text/plain",
+		},
+	})
+	if err := solver.Present(ch); err != nil {
+		t.Fatalf("unexpected error presenting: %v", err)
+	}
+
+	for i := range sources {
+		if sources[i] != "cluster-a" {
+			t.Errorf("expected the X-Request-Source header, got %q", sources[i])
+		}
+		if contentTypes[i] != "application/json" {
+			t.Errorf("expected the client's Content-Type header to be kept, got %q", contentTypes[i])
+		}
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		clusterID string
+		headers   map[string]string
+		want      string
+	}{
+		{name: "default", want: "cert-manager-webhook-dyndns/" + version},
+		{name: "cluster", clusterID: "prod-eu-1", want: "cert-manager-webhook-dyndns/" + version + " (prod-eu-1)"},
+		{name: "header override", clusterID: "prod-eu-1", headers: map[string]string{"user-agent": "custom"}, want: "custom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dyn := newFakeDyn()
+			var agents []string
+			dyn.handle = func(r *http.Request) (*http.Response, error) {
+				agents = append(agents, r.Header.Get("User-Agent"))
+				return nil, nil
+			}
+			solver := newTestSolver(dyn)
+			solver.clusterID = tt.clusterID
+			ch := withConfig(t, newTestChallenge(), map[string]interface{}{"headers": tt.headers})
+
+			if err := solver.Present(ch); err != nil {
+				t.Fatalf("unexpected error presenting: %v", err)
+			}
+			for _, agent := range agents {
+				if agent != tt.want {
+					t.Errorf("expected User-Agent %q, got %q", tt.want, agent)
+				}
+			}
+		})
+	}
+}